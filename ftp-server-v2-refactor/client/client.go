@@ -2,12 +2,17 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"ftp/common"
 	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func StartClient_(host string, port int, timeout int, verbose bool) {
@@ -19,24 +24,111 @@ func StartClient_(host string, port int, timeout int, verbose bool) {
 	// Placeholder for actual client logic
 }
 
+// Config holds the settings for StartClient.
+type Config struct {
+	// Addr is the ip:port of the server.
+	Addr string
+	// Active makes LIST, RETR and STOR set up an active mode (PORT/EPRT)
+	// data connection instead of a passive (EPSV/PASV) one when none has
+	// been prepared.
+	Active bool
+	// TLS upgrades the control connection with AUTH TLS right after the
+	// greeting and protects data connections with PROT P.
+	TLS bool
+	// ImplicitTLS connects with TLS from the first byte, for servers that
+	// only offer implicit FTPS on a dedicated port. Data connections are
+	// protected too.
+	ImplicitTLS bool
+	// Resume continues interrupted transfers: RETR appends to an existing
+	// local file and STOR continues from the size the server reports.
+	Resume bool
+	// InsecureSkipVerify accepts any server certificate, e.g. a self-signed
+	// one.
+	InsecureSkipVerify bool
+	// Verify compares the server's hash of each file with the local copy
+	// after RETR and STOR.
+	Verify bool
+}
+
+// session is the state of one connection to the server.
+type session struct {
+	cfg    Config
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	data   dataChannel
+
+	// tlsConfig is set once the control connection uses TLS
+	tlsConfig *tls.Config
+
+	// features maps each extension from the server's FEAT reply to its
+	// parameters
+	features map[string]string
+
+	// noEpsv is set once the server has rejected EPSV, so automatic passive
+	// connections go straight to PASV.
+	noEpsv bool
+
+	// transferType is the representation type for RETR and STOR, "I"
+	// (binary) unless changed with TYPE, ASCII or BINARY. serverType is the
+	// type last accepted by the server, empty until we have sent one.
+	transferType string
+	serverType   string
+
+	// modeChosen is set once MODE has been sent, by syncMode or the user.
+	modeChosen bool
+}
 
-func StartClient(serverAddr *string) {
-	conn, err := net.Dial("tcp", *serverAddr)
+var errConnClosed = errors.New("connection closed")
+
+func StartClient(cfg Config) {
+	var conn net.Conn
+	var err error
+	var implicitConfig *tls.Config
+	if cfg.ImplicitTLS {
+		implicitConfig = newTLSConfig(cfg)
+		conn, err = tls.Dial("tcp", cfg.Addr, implicitConfig)
+	} else {
+		conn, err = net.Dial("tcp", cfg.Addr)
+	}
 	if err != nil {
 		fmt.Println("Failed to connect:", err)
 		return
 	}
-	defer conn.Close()
+	s := &session{
+		cfg:          cfg,
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		writer:       bufio.NewWriter(conn),
+		transferType: "I",
+	}
+	// s.conn is replaced by a TLS connection after AUTH TLS
+	defer func() { s.conn.Close() }()
+	defer s.data.close()
 
-	reader := bufio.NewReader(conn)
 	console := bufio.NewReader(os.Stdin)
-	writer := bufio.NewWriter(conn)
 
 	// Read welcome message
-	line, _ := reader.ReadString('\n')
-	fmt.Print("Server: " + line)
+	if _, err := s.readReply(); err != nil {
+		fmt.Println("Connection closed")
+		return
+	}
 
-	var dataConn net.Conn = nil
+	switch {
+	case cfg.ImplicitTLS:
+		err = s.protectData(implicitConfig)
+	case cfg.TLS:
+		err = s.startTLS()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if err := s.loadFeatures(); err != nil {
+		fmt.Println("Connection closed")
+		return
+	}
 
 	for {
 		fmt.Print("ftp> ")
@@ -49,289 +141,847 @@ func StartClient(serverAddr *string) {
 			continue
 		}
 
-		cmdUpper := strings.ToUpper(cmdLine)
-
-		// Special handling for PASV command to get data port info
-		if cmdUpper == "PASV" {
-			writer.WriteString(cmdLine + "\r\n")
-			writer.Flush()
+		cmd, arg, _ := strings.Cut(cmdLine, " ")
+		cmd = strings.ToUpper(cmd)
+		arg = strings.TrimSpace(arg)
 
-			resp, err := reader.ReadString('\n')
-			if err != nil {
-				fmt.Println("Connection closed")
-				return
+		switch cmd {
+		case "PASV":
+			err = s.pasv()
+		case "EPSV":
+			if arg == "" {
+				_, err = s.epsv()
+			} else {
+				// EPSV ALL and friends need no data connection
+				_, err = s.command(cmdLine)
 			}
-			fmt.Print("Server: " + resp)
+		case "PORT":
+			err = s.port(false)
+		case "EPRT":
+			err = s.port(true)
+		case "PROT":
+			err = s.prot(cmdLine, arg)
+		case "TYPE":
+			err = s.setType(arg)
+		case "MODE":
+			err = s.setMode(arg)
+		case "ASCII":
+			err = s.setType("A")
+		case "BINARY":
+			err = s.setType("I")
+		case "LIST":
+			err = s.list(cmdLine, arg)
+		case "MLSD", "NLST":
+			err = s.rawList(cmdLine)
+		case "STOR", "APPE", "STOU":
+			err = s.stor(cmd, arg)
+		case "RETR":
+			err = s.retr(arg)
+		case "DELETE":
+			_, err = s.command("DELE " + arg)
+		case "MKDIR":
+			_, err = s.command("MKD " + arg)
+		case "RMDIR":
+			_, err = s.command("RMD " + arg)
+		case "RENAME":
+			err = s.rename(arg)
+		case "CHECK":
+			err = s.check(arg)
+		default:
+			// For other commands, just send and print response normally
+			_, err = s.command(cmdLine)
+		}
 
-			// Parse PASV response e.g. 227 Entering Passive Mode (127,0,0,1,168,161)
-			start := strings.Index(resp, "(")
-			end := strings.Index(resp, ")")
-			if start == -1 || end == -1 || end <= start {
-				fmt.Println("Failed to parse PASV response")
-				continue
-			}
+		if err == errConnClosed {
+			fmt.Println("Connection closed")
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
 
-			addrParts := strings.Split(resp[start+1:end], ",")
-			if len(addrParts) != 6 {
-				fmt.Println("Unexpected PASV address format")
-				continue
-			}
+		if cmd == "QUIT" {
+			break
+		}
+	}
+}
 
-			ip := strings.Join(addrParts[0:4], ".")
-			p1 := common.Atoi(addrParts[4])
-			p2 := common.Atoi(addrParts[5])
-			port := p1*256 + p2
+// startTLS upgrades the control connection with AUTH TLS (RFC 4217) and turns
+// on protection for data connections.
+func (s *session) startTLS() error {
+	resp, err := s.command("AUTH TLS")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "234") {
+		return errors.New("Server refused AUTH TLS")
+	}
 
-			dataConn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", ip, port))
-			if err != nil {
-				fmt.Println("Failed to connect to data port:", err)
-				dataConn = nil
-			} else {
-				fmt.Printf("Data connection established to %s:%d\n", ip, port)
-			}
+	tlsConfig := newTLSConfig(s.cfg)
+	tlsConn := tls.Client(s.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.writer = bufio.NewWriter(tlsConn)
 
-			continue
+	return s.protectData(tlsConfig)
+}
+
+// protectData turns on TLS for data connections once the control connection
+// is secure. Data connections share tlsConfig, and so its session cache, with
+// the control connection.
+func (s *session) protectData(tlsConfig *tls.Config) error {
+	s.tlsConfig = tlsConfig
+
+	if _, err := s.command("PBSZ 0"); err != nil {
+		return err
+	}
+	resp, err := s.command("PROT P")
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(resp, "200") || s.cfg.ImplicitTLS {
+		s.data.tlsConfig = s.tlsConfig
+	}
+	return nil
+}
+
+func newTLSConfig(cfg Config) *tls.Config {
+	host, _, _ := net.SplitHostPort(cfg.Addr)
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		// Many servers require data connections to resume the control
+		// connection's TLS session
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+}
+
+// prot changes the data connection protection level and keeps our side of
+// the data connections in step with the server.
+func (s *session) prot(cmdLine, level string) error {
+	resp, err := s.command(cmdLine)
+	if err != nil || !strings.HasPrefix(resp, "200") {
+		return err
+	}
+	if strings.EqualFold(level, "P") {
+		s.data.tlsConfig = s.tlsConfig
+	} else {
+		s.data.tlsConfig = nil
+	}
+	return nil
+}
+
+// setType sends TYPE and, if the server accepts it, uses the type for the
+// following transfers.
+func (s *session) setType(arg string) error {
+	resp, err := s.command("TYPE " + arg)
+	if err != nil || !strings.HasPrefix(resp, "200") {
+		return err
+	}
+	switch strings.Join(strings.Fields(strings.ToUpper(arg)), " ") {
+	case "A", "A N":
+		s.transferType = "A"
+	case "I", "L 8":
+		s.transferType = "I"
+	}
+	s.serverType = s.transferType
+	return nil
+}
+
+// syncType makes sure the server uses our transfer type before RETR or STOR.
+func (s *session) syncType() error {
+	if s.serverType == s.transferType {
+		return nil
+	}
+	resp, err := s.command("TYPE " + s.transferType)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "200") {
+		return fmt.Errorf("Server refused TYPE %s", s.transferType)
+	}
+	s.serverType = s.transferType
+	return nil
+}
+
+// setMode sends MODE and, if the server accepts it, compresses the following
+// transfers for MODE Z.
+func (s *session) setMode(arg string) error {
+	resp, err := s.command("MODE " + arg)
+	if err != nil || !strings.HasPrefix(resp, "200") {
+		return err
+	}
+	s.modeChosen = true
+	s.data.compress = strings.EqualFold(arg, "Z")
+	return nil
+}
+
+// syncMode turns on MODE Z before the first transfer if the server supports
+// it, unless a mode has already been chosen.
+func (s *session) syncMode() error {
+	if s.modeChosen || s.features["MODE"] != "Z" {
+		return nil
+	}
+	resp, err := s.command("MODE Z")
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(resp, "530") {
+		// Try again once logged in
+		return nil
+	}
+	s.modeChosen = true
+	s.data.compress = strings.HasPrefix(resp, "200")
+	return nil
+}
+
+// send writes one command line to the server.
+func (s *session) send(line string) error {
+	s.writer.WriteString(line + "\r\n")
+	return s.writer.Flush()
+}
+
+// readReply reads a complete, possibly multi-line, reply and prints it. It
+// returns the last line, which carries the final reply code.
+func (s *session) readReply() (string, error) {
+	lines, err := s.readReplyLines()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range lines {
+		fmt.Println("Server: " + line)
+	}
+	return lines[len(lines)-1], nil
+}
+
+// readReplyLines reads a complete reply without printing it.
+func (s *session) readReplyLines() ([]string, error) {
+	var lines []string
+	for {
+		resp, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, errConnClosed
 		}
+		resp = strings.TrimRight(resp, "\r\n")
+		lines = append(lines, resp)
+		// Responses start with 3-digit code and a space means last line
+		if len(resp) >= 4 && resp[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
 
-		// Handle LIST command
-		if cmdUpper == "LIST" {
-			if dataConn == nil {
-				fmt.Println("No data connection established. Use PASV first.")
-				continue
-			}
+// loadFeatures asks the server which extensions it supports (FEAT, RFC 2389)
+// without printing the reply.
+func (s *session) loadFeatures() error {
+	if err := s.send("FEAT"); err != nil {
+		return errConnClosed
+	}
+	lines, err := s.readReplyLines()
+	if err != nil {
+		return err
+	}
+	s.features = parseFeatures(lines)
+	return nil
+}
 
-			writer.WriteString(cmdLine + "\r\n")
-			writer.Flush()
-
-			// Read control responses until 150
-			for {
-				resp, err := reader.ReadString('\n')
-				if err != nil {
-					fmt.Println("Connection closed")
-					return
-				}
-				fmt.Print("Server: " + resp)
-				if strings.HasPrefix(resp, "150") {
-					break
-				}
-				if strings.HasPrefix(resp, "425") || strings.HasPrefix(resp, "530") {
-					break
-				}
-			}
+// command sends line and reads the reply.
+func (s *session) command(line string) (string, error) {
+	if err := s.send(line); err != nil {
+		return "", errConnClosed
+	}
+	return s.readReply()
+}
 
-			// Now read directory listing from dataConn
-			dataReader := bufio.NewReader(dataConn)
-			for {
-				line, err := dataReader.ReadString('\n')
-				if err != nil {
-					break
-				}
-				fmt.Print(line)
-			}
-			dataConn.Close()
-			dataConn = nil
-
-			// Read final confirmation after data transfer
-			for {
-				resp, err := reader.ReadString('\n')
-				if err != nil {
-					fmt.Println("Connection closed")
-					return
-				}
-				fmt.Print("Server: " + resp)
-				if len(resp) >= 4 && resp[3] == ' ' {
-					break
-				}
-			}
+// pasv asks the server for a passive data connection and dials it.
+func (s *session) pasv() error {
+	resp, err := s.command("PASV")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "227") {
+		return nil
+	}
 
-			continue
+	addr, err := parsePasvReply(resp)
+	if err != nil {
+		return err
+	}
+
+	dataConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to data port: %v", err)
+	}
+	s.data.setConn(dataConn)
+	fmt.Printf("Data connection established to %s\n", addr)
+	return nil
+}
+
+// epsv asks the server for an extended passive data connection (RFC 2428)
+// and dials it on the server's control address. It reports whether the server
+// accepted EPSV.
+func (s *session) epsv() (bool, error) {
+	resp, err := s.command("EPSV")
+	if err != nil {
+		return false, err
+	}
+	if !strings.HasPrefix(resp, "229") {
+		return false, nil
+	}
+
+	port, err := parseEpsvReply(resp)
+	if err != nil {
+		return true, err
+	}
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	addr := net.JoinHostPort(host, port)
+
+	dataConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return true, fmt.Errorf("Failed to connect to data port: %v", err)
+	}
+	s.data.setConn(dataConn)
+	fmt.Printf("Data connection established to %s\n", addr)
+	return true, nil
+}
+
+// port listens on the control connection's local address and tells the server
+// to connect there, using EPRT if extended is set and PORT otherwise.
+func (s *session) port(extended bool) error {
+	localIP := s.conn.LocalAddr().(*net.TCPAddr).IP
+	ln, err := net.Listen("tcp", net.JoinHostPort(localIP.String(), "0"))
+	if err != nil {
+		return fmt.Errorf("Failed to open data port: %v", err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+
+	var line string
+	if extended {
+		line = formatEprtArg(addr)
+	} else {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			ln.Close()
+			return errors.New("PORT needs an IPv4 connection, use EPRT")
 		}
+		line = fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], addr.Port/256, addr.Port%256)
+	}
 
-		if strings.HasPrefix(cmdUpper, "STOR") {
-			if dataConn == nil {
-				fmt.Println("No data connection established. Use PASV first.")
-				continue
-			}
+	resp, err := s.command(line)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	if !strings.HasPrefix(resp, "200") {
+		ln.Close()
+		return nil
+	}
+	s.data.setListener(ln)
+	fmt.Printf("Listening for data connection on %s\n", addr)
+	return nil
+}
 
-			parts := strings.SplitN(cmdLine, " ", 2)
-			if len(parts) < 2 {
-				fmt.Println("No filename specified for STOR")
-				continue
-			}
-			filename := parts[1]
-
-			// Open local file
-			file, err := os.Open(filename)
-			if err != nil {
-				fmt.Println("Failed to open file:", err)
-				dataConn.Close()
-				dataConn = nil
-				continue
-			}
+// prepareData makes sure a data connection has been negotiated. Unless
+// configured for active mode it prefers EPSV and falls back to PASV.
+func (s *session) prepareData() error {
+	if s.data.ready() {
+		return nil
+	}
 
-			// Send STOR command
-			writer.WriteString(cmdLine + "\r\n")
-			writer.Flush()
-
-			// Wait for 150
-			transferOkay := false
-			for {
-				resp, err := reader.ReadString('\n')
-				if err != nil {
-					fmt.Println("Connection closed")
-					return
-				}
-				fmt.Print("Server: " + resp)
-				if strings.HasPrefix(resp, "150") {
-					transferOkay = true
-					break
-				}
-				if strings.HasPrefix(resp, "425") || strings.HasPrefix(resp, "530") || strings.HasPrefix(resp, "550") {
-					dataConn.Close()
-					dataConn = nil
-					transferOkay = false
-					break
-				}
-			}
+	if s.cfg.Active {
+		ip := s.conn.LocalAddr().(*net.TCPAddr).IP
+		if err := s.port(ip.To4() == nil); err != nil {
+			return err
+		}
+		if !s.data.ready() {
+			return errors.New("Server refused active mode data connection")
+		}
+		return nil
+	}
 
-			if !transferOkay {
-				file.Close()
-				continue
-			}
+	if !s.noEpsv {
+		ok, err := s.epsv()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		s.noEpsv = true
+	}
+	if err := s.pasv(); err != nil {
+		return err
+	}
+	if !s.data.ready() {
+		return errors.New("Server refused passive mode data connection")
+	}
+	return nil
+}
 
-			// Upload file bytes
-			_, err = io.Copy(dataConn, file)
-			file.Close()
+// startTransfer sends a transfer command and waits for the 150 reply. It
+// returns the open data connection, or nil if the server refused.
+func (s *session) startTransfer(line string) (net.Conn, error) {
+	if err := s.send(line); err != nil {
+		s.data.close()
+		return nil, errConnClosed
+	}
+	resp, err := s.readReply()
+	if err != nil {
+		s.data.close()
+		return nil, err
+	}
+	if !strings.HasPrefix(resp, "150") && !strings.HasPrefix(resp, "125") {
+		// Error replies
+		s.data.close()
+		return nil, nil
+	}
+	return s.data.open()
+}
+
+// abortOnInterrupt lets Ctrl-C abort the transfer on dataConn: ABOR is sent
+// and the data connection closed. Call the returned stop function once the
+// transfer has ended; it reports whether the transfer was aborted.
+func (s *session) abortOnInterrupt(dataConn net.Conn) (stop func() bool) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-sig:
+			fmt.Println("\nAborting transfer")
+			// The main goroutine is busy copying data and won't use the
+			// control connection until stop returns
+			s.send("ABOR")
 			dataConn.Close()
-			dataConn = nil
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+
+	return func() bool {
+		signal.Stop(sig)
+		close(done)
+		return <-aborted
+	}
+}
+
+// finishTransfer reads the final reply of a transfer and, if it was aborted,
+// the reply to ABOR. It returns the transfer's reply.
+func (s *session) finishTransfer(aborted bool) (string, error) {
+	resp, err := s.readReply()
+	if err != nil {
+		return "", err
+	}
+	if !aborted {
+		return resp, nil
+	}
+	if _, err := s.readReply(); err != nil {
+		return "", err
+	}
+	return "", errors.New("Transfer aborted")
+}
+
+// Handle LIST command. When the server supports MLSD the listing is fetched
+// in machine-readable form and formatted here.
+func (s *session) list(cmdLine, arg string) error {
+	if _, ok := s.features["MLST"]; ok && strings.EqualFold(cmdLine[:4], "LIST") {
+		return s.mlsd(arg)
+	}
+	return s.rawList(cmdLine)
+}
+
+// rawList runs a listing command and prints the data as the server sent it.
+func (s *session) rawList(cmdLine string) error {
+	if err := s.syncMode(); err != nil {
+		return err
+	}
+	if err := s.prepareData(); err != nil {
+		return err
+	}
+	dataConn, err := s.startTransfer(cmdLine)
+	if err != nil || dataConn == nil {
+		return err
+	}
 
-			if err != nil {
-				fmt.Println("Error uploading file:", err)
+	// Now read directory listing from dataConn; listings are always text
+	stop := s.abortOnInterrupt(dataConn)
+	r, readErr := s.data.reader(dataConn)
+	if readErr == nil {
+		io.Copy(os.Stdout, common.FromCRLF(r))
+	}
+	dataConn.Close()
+
+	// Read final confirmation after data transfer
+	if _, err := s.finishTransfer(stop()); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// mlsd lists dir with MLSD (RFC 3659) and prints one line per entry.
+func (s *session) mlsd(dir string) error {
+	if err := s.syncMode(); err != nil {
+		return err
+	}
+	if err := s.prepareData(); err != nil {
+		return err
+	}
+	line := "MLSD"
+	if dir != "" {
+		line += " " + dir
+	}
+	dataConn, err := s.startTransfer(line)
+	if err != nil || dataConn == nil {
+		return err
+	}
+
+	stop := s.abortOnInterrupt(dataConn)
+	r, readErr := s.data.reader(dataConn)
+	if readErr == nil {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			entry, ok := parseMlsdLine(scanner.Text())
+			if !ok {
 				continue
 			}
+			fmt.Println(entry.String())
+		}
+	}
+	dataConn.Close()
 
-			// Wait for final response (226)
-			for {
-				resp, err := reader.ReadString('\n')
-				if err != nil {
-					fmt.Println("Connection closed")
-					return
-				}
-				fmt.Print("Server: " + resp)
-				if len(resp) >= 4 && resp[3] == ' ' {
-					break
-				}
-			}
+	if _, err := s.finishTransfer(stop()); err != nil {
+		return err
+	}
+	return readErr
+}
 
-			continue
+// stor uploads filename with verb STOR or APPE. With Config.Resume a STOR
+// continues a partial upload from the size the server already has.
+func (s *session) stor(verb, filename string) error {
+	if filename == "" {
+		return fmt.Errorf("No filename specified for %s", verb)
+	}
+	if err := s.syncType(); err != nil {
+		return err
+	}
+	if err := s.syncMode(); err != nil {
+		return err
+	}
+	if err := s.prepareData(); err != nil {
+		return err
+	}
+
+	// Open local file
+	file, err := os.Open(filename)
+	if err != nil {
+		s.data.close()
+		return fmt.Errorf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	// Offsets are only meaningful in binary mode
+	if s.cfg.Resume && verb == "STOR" && s.transferType == "I" {
+		offset, err := s.resumeUpload(file, filename)
+		if err != nil {
+			s.data.close()
+			return err
 		}
+		if offset < 0 {
+			s.data.close()
+			return nil
+		}
+	}
 
-		// Handle RETR (download) command
-		if strings.HasPrefix(cmdUpper, "RETR") {
-			if dataConn == nil {
-				fmt.Println("No data connection established. Use PASV first.")
-				continue
-			}
+	dataConn, err := s.startTransfer(verb + " " + filename)
+	if err != nil || dataConn == nil {
+		return err
+	}
 
-			// Send RETR command
-			writer.WriteString(cmdLine + "\r\n")
-			writer.Flush()
-
-			// Wait for "150" reply from server before reading data
-			transferStarted := false
-			for {
-				resp, err := reader.ReadString('\n')
-				if err != nil {
-					fmt.Println("Connection closed")
-					return
-				}
-				fmt.Print("Server: " + resp)
-				if strings.HasPrefix(resp, "150") {
-					transferStarted = true
-					break
-				}
-				if strings.HasPrefix(resp, "425") || strings.HasPrefix(resp, "530") || strings.HasPrefix(resp, "550") {
-					// Error replies
-					dataConn.Close()
-					dataConn = nil
-					transferStarted = false
-					break
-				}
-			}
+	// Upload file bytes
+	var src io.Reader = file
+	if s.transferType == "A" {
+		src = common.ToCRLF(file)
+	}
+	stop := s.abortOnInterrupt(dataConn)
+	w := s.data.writer(dataConn)
+	_, copyErr := io.Copy(w, src)
+	if err := w.Close(); copyErr == nil {
+		copyErr = err
+	}
+	dataConn.Close()
 
-			if !transferStarted {
-				continue
-			}
+	// Wait for final response (226)
+	resp, err := s.finishTransfer(stop())
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return fmt.Errorf("Error uploading file: %v", copyErr)
+	}
+	if verb == "STOR" && strings.HasPrefix(resp, "2") {
+		if err := s.copyModTimeUp(file, filename); err != nil {
+			return err
+		}
+	}
+	if s.cfg.Verify && verb == "STOR" {
+		return s.verify(filename)
+	}
+	return nil
+}
 
-			// Parse filename from command line for local saving
-			parts := strings.SplitN(cmdLine, " ", 2)
-			if len(parts) < 2 {
-				fmt.Println("No filename specified for RETR")
-				dataConn.Close()
-				dataConn = nil
-				continue
-			}
-			filename := parts[1]
-
-			// Open local file to save
-			file, err := os.Create(filename)
-			if err != nil {
-				fmt.Println("Failed to create local file:", err)
-				dataConn.Close()
-				dataConn = nil
-				continue
-			}
+// resumeUpload asks the server how much of filename it already has and, if
+// that is a prefix of the local file, sends REST and seeks file past it. It
+// returns the offset to upload from, or -1 if the upload is already complete.
+func (s *session) resumeUpload(file *os.File, filename string) (int64, error) {
+	remoteSize, ok, err := s.size(filename)
+	if err != nil || !ok || remoteSize == 0 {
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if remoteSize == info.Size() {
+		fmt.Println("Remote file is already complete")
+		return -1, nil
+	}
+	if remoteSize > info.Size() {
+		// Remote file is not a partial copy of ours; start over
+		return 0, nil
+	}
 
-			// Copy data from data connection to file
-			_, err = io.Copy(file, dataConn)
-			file.Close()
-			dataConn.Close()
-			dataConn = nil
+	resp, err := s.command(fmt.Sprintf("REST %d", remoteSize))
+	if err != nil || !strings.HasPrefix(resp, "350") {
+		return 0, err
+	}
+	if _, err := file.Seek(remoteSize, io.SeekStart); err != nil {
+		return 0, err
+	}
+	fmt.Printf("Resuming upload at byte %d\n", remoteSize)
+	return remoteSize, nil
+}
 
-			if err != nil {
-				fmt.Println("Error downloading file:", err)
-				continue
-			}
+// resumeDownload takes an existing local filename as a partial download and,
+// if it is smaller than the remote file, sends REST for its size. It returns
+// the offset to download from, or -1 if the download is already complete.
+func (s *session) resumeDownload(filename string) (int64, error) {
+	info, err := os.Stat(filename)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return 0, nil
+	}
+	remoteSize, ok, err := s.size(filename)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if remoteSize == info.Size() {
+		fmt.Println("Local file is already complete")
+		return -1, nil
+	}
+	if remoteSize < info.Size() {
+		// Local file is not a partial copy of the remote one; start over
+		return 0, nil
+	}
 
-			// Read final server response after data transfer
-			for {
-				resp, err := reader.ReadString('\n')
-				if err != nil {
-					fmt.Println("Connection closed")
-					return
-				}
-				fmt.Print("Server: " + resp)
-				if len(resp) >= 4 && resp[3] == ' ' {
-					break
-				}
-			}
+	resp, err := s.command(fmt.Sprintf("REST %d", info.Size()))
+	if err != nil || !strings.HasPrefix(resp, "350") {
+		return 0, err
+	}
+	fmt.Printf("Resuming download at byte %d\n", info.Size())
+	return info.Size(), nil
+}
 
-			continue
+// size returns the size of a remote file. ok is false if the server could not
+// tell.
+func (s *session) size(name string) (int64, bool, error) {
+	resp, err := s.command("SIZE " + name)
+	if err != nil {
+		return 0, false, err
+	}
+	if !strings.HasPrefix(resp, "213 ") {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(resp[4:]), 10, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+	return n, true, nil
+}
+
+// modTime returns the modification time of a remote file. ok is false if the
+// server could not tell.
+func (s *session) modTime(name string) (time.Time, bool, error) {
+	resp, err := s.command("MDTM " + name)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !strings.HasPrefix(resp, "213 ") {
+		return time.Time{}, false, nil
+	}
+	t, err := time.ParseInLocation("20060102150405", strings.TrimSpace(resp[4:]), time.UTC)
+	if err != nil {
+		return time.Time{}, false, nil
+	}
+	return t, true, nil
+}
+
+// copyModTimeUp gives the remote filename the modification time of the
+// local file with MFMT, if the server supports it, so CHECK sees them as
+// unchanged.
+func (s *session) copyModTimeUp(file *os.File, filename string) error {
+	if _, ok := s.features["MFMT"]; !ok {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.command("MFMT " + info.ModTime().UTC().Format("20060102150405") + " " + filename)
+	return err
+}
+
+// copyModTimeDown gives the local filename the modification time of the
+// remote file from MDTM.
+func (s *session) copyModTimeDown(filename string) error {
+	t, ok, err := s.modTime(filename)
+	if err != nil || !ok {
+		return err
+	}
+	return os.Chtimes(filename, time.Time{}, t)
+}
+
+// check compares a local file with the remote file of the same name using
+// SIZE and MDTM, without transferring it.
+func (s *session) check(filename string) error {
+	if filename == "" {
+		return errors.New("Usage: CHECK file")
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("Failed to stat local file: %v", err)
+	}
+
+	remoteSize, ok, err := s.size(filename)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Remote file missing or size unknown")
+		return nil
+	}
+	remoteTime, ok, err := s.modTime(filename)
+	if err != nil {
+		return err
+	}
+
+	localTime := info.ModTime().UTC().Truncate(time.Second)
+	switch {
+	case remoteSize != info.Size():
+		fmt.Printf("Changed: size %d local, %d remote\n", info.Size(), remoteSize)
+	case !ok:
+		fmt.Println("Same size, remote modification time unknown")
+	case !remoteTime.Equal(localTime):
+		fmt.Printf("Changed: modified %s local, %s remote\n", localTime.Format(time.RFC3339), remoteTime.Format(time.RFC3339))
+	default:
+		fmt.Println("Unchanged")
+	}
+	return nil
+}
+
+// Handle RETR (download) command. With Config.Resume an existing local file is
+// taken as a partial download and only the rest is fetched.
+func (s *session) retr(filename string) error {
+	if filename == "" {
+		return errors.New("No filename specified for RETR")
+	}
+	if err := s.syncType(); err != nil {
+		return err
+	}
+	if err := s.syncMode(); err != nil {
+		return err
+	}
+	if err := s.prepareData(); err != nil {
+		return err
+	}
+
+	var offset int64
+	if s.cfg.Resume && s.transferType == "I" {
+		var err error
+		offset, err = s.resumeDownload(filename)
+		if err != nil {
+			s.data.close()
+			return err
+		}
+		if offset < 0 {
+			s.data.close()
+			return nil
 		}
+	}
+
+	dataConn, err := s.startTransfer("RETR " + filename)
+	if err != nil || dataConn == nil {
+		return err
+	}
 
-		// For other commands, just send and print response normally
-		writer.WriteString(cmdLine + "\r\n")
-		writer.Flush()
+	// Open local file to save
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		dataConn.Close()
+		s.readReply()
+		return fmt.Errorf("Failed to create local file: %v", err)
+	}
 
-		// Read server response(s)
-		for {
-			resp, err := reader.ReadString('\n')
-			if err != nil {
-				fmt.Println("Connection closed")
-				return
-			}
-			fmt.Print("Server: " + resp)
-			if len(resp) < 4 {
-				continue
-			}
-			// Responses start with 3-digit code and a space means last line
-			if resp[3] == ' ' {
-				break
-			}
+	// Copy data from data connection to file
+	stop := s.abortOnInterrupt(dataConn)
+	src, copyErr := s.data.reader(dataConn)
+	if copyErr == nil {
+		if s.transferType == "A" {
+			src = common.FromCRLF(src)
 		}
+		_, copyErr = io.Copy(file, src)
+	}
+	file.Close()
+	dataConn.Close()
 
-		if cmdUpper == "QUIT" {
-			break
+	// Read final server response after data transfer
+	resp, err := s.finishTransfer(stop())
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return fmt.Errorf("Error downloading file: %v", copyErr)
+	}
+	if strings.HasPrefix(resp, "2") {
+		if err := s.copyModTimeDown(filename); err != nil {
+			return err
 		}
 	}
+	if s.cfg.Verify {
+		return s.verify(filename)
+	}
+	return nil
+}
+
+// rename renames a remote file with RNFR followed by RNTO. arg is
+// "from to"; neither name may contain spaces.
+func (s *session) rename(arg string) error {
+	names := strings.Fields(arg)
+	if len(names) != 2 {
+		return errors.New("Usage: RENAME from to")
+	}
+	resp, err := s.command("RNFR " + names[0])
+	if err != nil || !strings.HasPrefix(resp, "350") {
+		return err
+	}
+	_, err = s.command("RNTO " + names[1])
+	return err
 }
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"compress/zlib"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"ftp/common"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dataConnTimeout bounds how long we wait for the server to connect back in
+// active mode.
+const dataConnTimeout = 30 * time.Second
+
+// dataChannel is the data connection prepared for the next transfer: either
+// already dialled after PASV, or listening for the server after PORT/EPRT.
+type dataChannel struct {
+	conn     net.Conn
+	listener net.Listener
+
+	// tlsConfig is set after PROT P; data connections are then protected
+	// with TLS.
+	tlsConfig *tls.Config
+
+	// compress is set after MODE Z; data is then sent as a deflate stream.
+	compress bool
+}
+
+func (d *dataChannel) ready() bool {
+	return d.conn != nil || d.listener != nil
+}
+
+func (d *dataChannel) setConn(conn net.Conn) {
+	d.close()
+	d.conn = conn
+}
+
+func (d *dataChannel) setListener(ln net.Listener) {
+	d.close()
+	d.listener = ln
+}
+
+// open returns the data connection, accepting the server's connection in
+// active mode. The prepared channel is used up either way.
+func (d *dataChannel) open() (net.Conn, error) {
+	conn := d.conn
+	d.conn = nil
+	if ln := d.listener; ln != nil {
+		d.listener = nil
+		defer ln.Close()
+		if tl, ok := ln.(*net.TCPListener); ok {
+			tl.SetDeadline(time.Now().Add(dataConnTimeout))
+		}
+		var err error
+		conn, err = ln.Accept()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to accept data connection: %v", err)
+		}
+	}
+	if conn == nil {
+		return nil, errors.New("No data connection established")
+	}
+
+	if d.tlsConfig == nil {
+		return conn, nil
+	}
+	// We are always the TLS client, even when the server dialled us
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(dataConnTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake on data connection failed: %v", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// reader returns a reader for the data received on conn, decompressing it in
+// MODE Z.
+func (d *dataChannel) reader(conn net.Conn) (io.Reader, error) {
+	if !d.compress {
+		return conn, nil
+	}
+	zr, err := zlib.NewReader(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read compressed data: %v", err)
+	}
+	return zr, nil
+}
+
+// writer returns a writer for the data sent on conn, compressing it in MODE
+// Z. It must be closed to finish the stream.
+func (d *dataChannel) writer(conn net.Conn) io.WriteCloser {
+	if !d.compress {
+		return nopWriteCloser{conn}
+	}
+	return zlib.NewWriter(conn)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (d *dataChannel) close() {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+	if d.listener != nil {
+		d.listener.Close()
+		d.listener = nil
+	}
+}
+
+// parsePasvReply extracts the data address from a PASV reply such as
+// 227 Entering Passive Mode (127,0,0,1,168,161).
+func parsePasvReply(resp string) (string, error) {
+	start := strings.Index(resp, "(")
+	end := strings.Index(resp, ")")
+	if start == -1 || end == -1 || end <= start {
+		return "", errors.New("Failed to parse PASV response")
+	}
+
+	addrParts := strings.Split(resp[start+1:end], ",")
+	if len(addrParts) != 6 {
+		return "", errors.New("Unexpected PASV address format")
+	}
+
+	ip := strings.Join(addrParts[0:4], ".")
+	p1 := common.Atoi(addrParts[4])
+	p2 := common.Atoi(addrParts[5])
+	port := p1*256 + p2
+
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// parseEpsvReply extracts the port from an EPSV reply such as
+// 229 Entering Extended Passive Mode (|||6446|).
+func parseEpsvReply(resp string) (string, error) {
+	start := strings.Index(resp, "(")
+	end := strings.LastIndex(resp, ")")
+	if start == -1 || end == -1 || end-start < 6 {
+		return "", errors.New("Failed to parse EPSV response")
+	}
+
+	inner := resp[start+1 : end]
+	fields := strings.Split(inner, inner[:1])
+	if len(fields) != 5 {
+		return "", errors.New("Unexpected EPSV address format")
+	}
+	if port, err := strconv.Atoi(fields[3]); err != nil || port < 1 || port > 65535 {
+		return "", errors.New("Unexpected EPSV port")
+	}
+	return fields[3], nil
+}
+
+// formatEprtArg builds an EPRT command (RFC 2428) for addr.
+func formatEprtArg(addr *net.TCPAddr) string {
+	proto := 2
+	if addr.IP.To4() != nil {
+		proto = 1
+	}
+	return fmt.Sprintf("EPRT |%d|%s|%d|", proto, addr.IP, addr.Port)
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"ftp/common"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseFeatures parses the lines of a FEAT reply into a map from extension
+// name to its parameters, e.g. "MLST" -> "type*;size*;".
+func parseFeatures(lines []string) map[string]string {
+	features := make(map[string]string)
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "211") {
+		return features
+	}
+	// Feature lines sit between "211-Features:" and "211 End" and start
+	// with a space
+	for _, line := range lines[1 : len(lines)-1] {
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		name, params, _ := strings.Cut(strings.TrimSpace(line), " ")
+		features[strings.ToUpper(name)] = params
+	}
+	return features
+}
+
+// mlsdEntry is one line of an MLSD listing.
+type mlsdEntry struct {
+	name    string
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// parseMlsdLine parses "fact=value;fact=value; name". Entries for the current
+// and parent directory are skipped.
+func parseMlsdLine(line string) (mlsdEntry, bool) {
+	facts, name, found := strings.Cut(line, " ")
+	if !found || name == "" {
+		return mlsdEntry{}, false
+	}
+
+	entry := mlsdEntry{name: name}
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, _ := strings.Cut(fact, "=")
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "dir":
+				entry.isDir = true
+			case "cdir", "pdir":
+				return mlsdEntry{}, false
+			}
+		case "size":
+			entry.size, _ = strconv.ParseInt(value, 10, 64)
+		case "modify":
+			value, _, _ = strings.Cut(value, ".")
+			entry.modTime, _ = time.ParseInLocation("20060102150405", value, time.UTC)
+		}
+	}
+	return entry, true
+}
+
+// String formats the entry like the server's own listing.
+func (e mlsdEntry) String() string {
+	itemType := "File"
+	sizeStr := common.HumanReadableSize(e.size)
+	if e.isDir {
+		itemType = "Folder"
+		sizeStr = "-"
+	}
+	modTime := e.modTime.Local().Format("Jan _2 15:04")
+	return fmt.Sprintf("%-6s %-10s %-20s %s", itemType, sizeStr, modTime, e.name)
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// localHashes are the algorithms we can compute here, by their HASH name.
+var localHashes = map[string]func() hash.Hash{
+	"SHA-256": sha256.New,
+	"SHA-1":   sha1.New,
+	"MD5":     md5.New,
+	"CRC32":   func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// xHashCommands are the non-standard checksum commands, best first.
+var xHashCommands = []struct {
+	cmd, alg string
+}{
+	{"XSHA256", "SHA-256"},
+	{"XSHA1", "SHA-1"},
+	{"XMD5", "MD5"},
+	{"XCRC", "CRC32"},
+}
+
+// verify compares the hash of a local file with the server's hash of the
+// remote file of the same name, using HASH or else one of the X* commands.
+func (s *session) verify(filename string) error {
+	if s.transferType != "I" {
+		fmt.Println("Not verifying, ASCII mode changes line endings")
+		return nil
+	}
+
+	alg, remote, err := s.remoteHash(filename)
+	if err != nil {
+		return err
+	}
+	if alg == "" {
+		fmt.Println("Not verifying, the server offers no usable hash")
+		return nil
+	}
+
+	local, err := hashLocalFile(filename, localHashes[alg])
+	if err != nil {
+		return fmt.Errorf("Failed to hash local file: %v", err)
+	}
+	if !strings.EqualFold(local, remote) {
+		return fmt.Errorf("Verification failed: %s of %s is %s locally but %s on the server", alg, filename, local, remote)
+	}
+	fmt.Printf("Verified %s (%s)\n", filename, alg)
+	return nil
+}
+
+// remoteHash asks the server for the hash of filename. alg is empty if the
+// server supports no algorithm we know.
+func (s *session) remoteHash(filename string) (alg, sum string, err error) {
+	if alg := selectedHash(s.features["HASH"]); alg != "" {
+		resp, err := s.command("HASH " + filename)
+		if err != nil {
+			return "", "", err
+		}
+		// 213 SHA-256 0-49 <hash> <path>
+		fields := strings.Fields(resp)
+		if len(fields) >= 4 && fields[0] == "213" && localHashes[strings.ToUpper(fields[1])] != nil {
+			return strings.ToUpper(fields[1]), fields[3], nil
+		}
+	}
+
+	for _, x := range xHashCommands {
+		if _, ok := s.features[x.cmd]; !ok {
+			continue
+		}
+		resp, err := s.command(x.cmd + " " + filename)
+		if err != nil {
+			return "", "", err
+		}
+		fields := strings.Fields(resp)
+		if len(fields) >= 2 && fields[0] == "250" {
+			return x.alg, fields[1], nil
+		}
+	}
+	return "", "", nil
+}
+
+// selectedHash returns the algorithm marked as selected in the parameters of
+// a FEAT HASH line, e.g. "SHA-256*;SHA-1;MD5", if we can compute it.
+func selectedHash(params string) string {
+	for _, name := range strings.Split(params, ";") {
+		name, selected := strings.CutSuffix(strings.TrimSpace(name), "*")
+		name = strings.ToUpper(name)
+		if selected && localHashes[name] != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func hashLocalFile(filename string, newHash func() hash.Hash) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
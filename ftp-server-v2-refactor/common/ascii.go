@@ -0,0 +1,120 @@
+package common
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+)
+
+// localCRLF is true where text files already end lines with CRLF, so ASCII
+// mode transfers need no conversion.
+const localCRLF = runtime.GOOS == "windows"
+
+// ToCRLF returns a reader that converts the local line endings read from r to
+// the CRLF used on the wire in ASCII mode (TYPE A).
+func ToCRLF(r io.Reader) io.Reader {
+	if localCRLF {
+		return r
+	}
+	return &toCRLF{r: bufio.NewReader(r)}
+}
+
+// FromCRLF returns a reader that converts CRLF line endings read from r back
+// to the local convention. A CR that is not followed by LF is kept, so that
+// FromCRLF(ToCRLF(r)) always reproduces r.
+func FromCRLF(r io.Reader) io.Reader {
+	if localCRLF {
+		return r
+	}
+	return &fromCRLF{r: bufio.NewReader(r)}
+}
+
+type toCRLF struct {
+	r *bufio.Reader
+	// lf is set when the CR of a line ending has been returned but the LF
+	// did not fit
+	lf bool
+}
+
+func (t *toCRLF) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if t.lf {
+			p[n] = '\n'
+			n++
+			t.lf = false
+			continue
+		}
+		// Don't block for more input once we have something to return
+		if n > 0 && t.r.Buffered() == 0 {
+			break
+		}
+		c, err := t.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if c == '\n' {
+			p[n] = '\r'
+			t.lf = true
+		} else {
+			p[n] = c
+		}
+		n++
+	}
+	return n, nil
+}
+
+type fromCRLF struct {
+	r *bufio.Reader
+	// cr is set when a CR has been read and we don't know yet whether it
+	// starts a line ending
+	cr bool
+}
+
+func (f *fromCRLF) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && f.r.Buffered() == 0 {
+			break
+		}
+		c, err := f.r.ReadByte()
+		if err != nil {
+			if f.cr {
+				// The data ended with a lone CR
+				f.cr = false
+				p[n] = '\r'
+				n++
+				continue
+			}
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		if f.cr {
+			f.cr = false
+			if c == '\n' {
+				p[n] = '\n'
+				n++
+				continue
+			}
+			p[n] = '\r'
+			n++
+			if n == len(p) {
+				f.r.UnreadByte()
+				break
+			}
+		}
+		if c == '\r' {
+			f.cr = true
+			continue
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
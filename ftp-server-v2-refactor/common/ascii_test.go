@@ -0,0 +1,114 @@
+package common
+
+import (
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// readAllWith reads r to the end using a buffer of size bytes, so state kept
+// between Read calls is exercised.
+func readAllWith(r io.Reader, size int) (string, error) {
+	var out strings.Builder
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		out.Write(buf[:n])
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return out.String(), err
+		}
+	}
+}
+
+// sources returns readers of s that deliver it all at once and one byte per
+// Read.
+func sources(s string) map[string]func() io.Reader {
+	return map[string]func() io.Reader{
+		"whole":    func() io.Reader { return strings.NewReader(s) },
+		"one byte": func() io.Reader { return iotest.OneByteReader(strings.NewReader(s)) },
+	}
+}
+
+func testConversion(t *testing.T, name string, convert func(io.Reader) io.Reader, in, want string) {
+	t.Helper()
+	for srcName, src := range sources(in) {
+		for _, size := range []int{1, 2, 3, 4096} {
+			got, err := readAllWith(convert(src()), size)
+			if err != nil || got != want {
+				t.Errorf("%s(%q) from %s source, %d-byte reads = %q, %v; want %q", name, in, srcName, size, got, err, want)
+			}
+		}
+	}
+	if err := iotest.TestReader(convert(strings.NewReader(in)), []byte(want)); err != nil {
+		t.Errorf("%s(%q): %v", name, in, err)
+	}
+}
+
+func TestToCRLF(t *testing.T) {
+	if localCRLF {
+		t.Skip("no conversion where lines end with CRLF")
+	}
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"abc", "abc"},
+		{"a\nb\n", "a\r\nb\r\n"},
+		{"\n", "\r\n"},
+		{"\n\n\n", "\r\n\r\n\r\n"},
+		// CRs are passed through, so CRLF in the input gains a second CR
+		{"a\r\nb", "a\r\r\nb"},
+		{"lone\r", "lone\r"},
+	}
+	for _, tt := range tests {
+		testConversion(t, "ToCRLF", ToCRLF, tt.in, tt.want)
+	}
+}
+
+func TestFromCRLF(t *testing.T) {
+	if localCRLF {
+		t.Skip("no conversion where lines end with CRLF")
+	}
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"abc", "abc"},
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"\r\n", "\n"},
+		{"\r\n\r\n", "\n\n"},
+		{"a\rb", "a\rb"},
+		{"a\r\r\nb", "a\r\nb"},
+		{"\r\r", "\r\r"},
+		{"\r", "\r"},
+		{"end\r", "end\r"},
+		{"end\r\r", "end\r\r"},
+		{"a\nb", "a\nb"},
+	}
+	for _, tt := range tests {
+		testConversion(t, "FromCRLF", FromCRLF, tt.in, tt.want)
+	}
+}
+
+func TestCRLFRoundTrip(t *testing.T) {
+	inputs := []string{"", "plain", "a\nb\n", "a\r\nb\r\n", "\r", "\n", "\r\r\n\n\r", "x\r"}
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 200 {
+		b := make([]byte, rng.IntN(20))
+		for i := range b {
+			b[i] = "ab\r\n"[rng.IntN(4)]
+		}
+		inputs = append(inputs, string(b))
+	}
+
+	for _, in := range inputs {
+		for _, size := range []int{1, 2, 4096} {
+			src := iotest.OneByteReader(strings.NewReader(in))
+			got, err := readAllWith(FromCRLF(ToCRLF(src)), size)
+			if err != nil || got != in {
+				t.Errorf("FromCRLF(ToCRLF(%q)) with %d-byte reads = %q, %v", in, size, got, err)
+			}
+		}
+	}
+}
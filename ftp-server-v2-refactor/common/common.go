@@ -1,6 +1,6 @@
 package common
 
-
+import "fmt"
 
 func Atoi(s string) int {
 	n := 0
@@ -11,4 +11,23 @@ func Atoi(s string) int {
 		n = n*10 + int(c-'0')
 	}
 	return n
-}
\ No newline at end of file
+}
+
+// HumanReadableSize formats a byte count as e.g. "4.00 KB".
+func HumanReadableSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	value := float64(size) / float64(div)
+	units := []string{"KB", "MB", "GB", "TB"}
+	if exp >= len(units) {
+		exp = len(units) - 1
+	}
+	return fmt.Sprintf("%.2f %s", value, units[exp])
+}
@@ -1,3 +1,3 @@
 module ftp
 
-go 1.24.3
+go 1.25.0
@@ -1,22 +1,158 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"ftp/client"
 	"ftp/server"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-
 func main() {
-	mode := flag.String("mode", "client", "server or client")
+	mode := flag.String("mode", "client", "server, client or passwd")
 	serverAddr := flag.String("addr", "localhost:2121", "Ip:port of server hosting the file")
 	port := flag.String("port", ":2121", "Port to host")
 	sharedDir := flag.String("dir", "./", "Directory you want to share vis FTP")
+	usersFile := flag.String("users", "", "Users file with username:hash lines (see -mode=passwd)")
+	anonDir := flag.String("anon-dir", "", "Enable anonymous logins, read-only, rooted at this directory (relative to -dir)")
+	anonIncoming := flag.String("anon-incoming", "", "Upload-only directory for anonymous users, relative to -anon-dir")
+	pasvPorts := flag.String("pasv-ports", "", "Port range for passive data connections, e.g. 50000-50100")
+	pasvAddr := flag.String("pasv-addr", "", "IP or hostname to advertise in PASV replies, or \"control\" to use the control connection's address")
+	tlsCert := flag.String("tls-cert", "", "Server: PEM certificate for FTPS (AUTH TLS)")
+	tlsKey := flag.String("tls-key", "", "Server: PEM private key for -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Server: enable FTPS with a generated self-signed certificate (for testing)")
+	tlsRequired := flag.Bool("tls-required", false, "Server: refuse logins and transfers that are not protected by TLS")
+	implicitPort := flag.String("implicit-port", "", "Server: also listen for implicit FTPS on this port, e.g. :990")
+	listFormat := flag.String("list-format", server.ListUnix, "Server: LIST output, \"unix\" (ls -l, for standard clients) or \"pretty\"")
+	modeZLevel := flag.Int("mode-z-level", 6, "Server: MODE Z compression level 1-9, 0 disables MODE Z")
+	logCommands := flag.Bool("log-commands", false, "Server: log every command received (passwords hidden)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Server: close control connections idle this long, e.g. 5m, 0 for no limit")
+	dataTimeout := flag.Duration("data-timeout", 30*time.Second, "Server: how long to wait for a data connection to open")
+	commandRate := flag.Float64("command-rate", 0, "Server: commands per second allowed per session after a burst of 10, 0 for no limit")
+	implicitTLS := flag.Bool("implicit", false, "Client: connect with implicit FTPS")
+	useTLS := flag.Bool("tls", false, "Client: secure the connection with AUTH TLS")
+	insecure := flag.Bool("insecure", false, "Client: accept any server certificate, e.g. a self-signed one")
+	resume := flag.Bool("resume", false, "Client: resume interrupted RETR/STOR transfers with REST")
+	verify := flag.Bool("verify", false, "Client: check each RETR/STOR against the server's hash of the file")
+	active := flag.Bool("active", false, "Client: use active mode (PORT/EPRT) data connections automatically")
 	flag.Parse()
 
-	if *mode == "server" {
-		server.StartServer(*sharedDir, port)
-	} else {
-		client.StartClient(serverAddr)
+	switch *mode {
+	case "server":
+		cfg := server.Config{
+			SharedDir:    *sharedDir,
+			Addr:         *port,
+			AnonDir:      *anonDir,
+			AnonIncoming: *anonIncoming,
+			PassiveAddr:  *pasvAddr,
+			RequireTLS:   *tlsRequired,
+			ImplicitAddr: *implicitPort,
+			ListFormat:   *listFormat,
+			ModeZLevel:   *modeZLevel,
+			LogCommands:  *logCommands,
+			IdleTimeout:  *idleTimeout,
+			DataTimeout:  *dataTimeout,
+			Logger:       log.New(os.Stdout, "", log.LstdFlags),
+		}
+		if *modeZLevel < 0 || *modeZLevel > 9 {
+			fmt.Println("-mode-z-level must be between 0 and 9")
+			os.Exit(1)
+		}
+		if *listFormat != server.ListUnix && *listFormat != server.ListPretty {
+			fmt.Printf("Unknown list format %q\n", *listFormat)
+			os.Exit(1)
+		}
+		if *commandRate < 0 {
+			fmt.Println("-command-rate must not be negative")
+			os.Exit(1)
+		}
+		if *commandRate > 0 {
+			cfg.RateLimits = map[string]server.RateLimit{"*": {Rate: *commandRate, Burst: 10}}
+		}
+		if *pasvPorts != "" {
+			r, err := server.ParsePortRange(*pasvPorts)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			cfg.PassivePorts = r
+		}
+		if *usersFile != "" {
+			auth, err := server.NewFileAuthenticator(*usersFile)
+			if err != nil {
+				fmt.Println("Failed to load users file:", err)
+				os.Exit(1)
+			}
+			cfg.Auth = auth
+		} else if *anonDir == "" {
+			fmt.Println("Warning: no -users file given, all logins will be rejected")
+		}
+		switch {
+		case *tlsCert != "":
+			tlsConfig, err := server.LoadTLSConfig(*tlsCert, *tlsKey)
+			if err != nil {
+				fmt.Println("Failed to load TLS certificate:", err)
+				os.Exit(1)
+			}
+			cfg.TLSConfig = tlsConfig
+		case *tlsSelfSigned:
+			tlsConfig, err := server.SelfSignedTLSConfig("localhost", "127.0.0.1", "::1")
+			if err != nil {
+				fmt.Println("Failed to generate TLS certificate:", err)
+				os.Exit(1)
+			}
+			cfg.TLSConfig = tlsConfig
+		}
+		if (cfg.RequireTLS || cfg.ImplicitAddr != "") && cfg.TLSConfig == nil {
+			fmt.Println("-tls-required and -implicit-port need -tls-cert/-tls-key or -tls-self-signed")
+			os.Exit(1)
+		}
+
+		// Stop on Ctrl-C or SIGTERM, giving running transfers time to finish
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		srv := server.NewServer(server.WithConfig(cfg))
+		if err := srv.ListenAndServe(ctx); !errors.Is(err, server.ErrServerClosed) {
+			fmt.Println("Server failed:", err)
+			os.Exit(1)
+		}
+		cfg.Logger.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			cfg.Logger.Println("Closed remaining connections:", err)
+		}
+	case "passwd":
+		// Read a password from stdin and print the hash for the users file
+		fmt.Print("Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			fmt.Println("Failed to read password:", err)
+			os.Exit(1)
+		}
+		hash, err := server.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			fmt.Println("Failed to hash password:", err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+	default:
+		client.StartClient(client.Config{
+			Addr:               *serverAddr,
+			Active:             *active,
+			TLS:                *useTLS,
+			ImplicitTLS:        *implicitTLS,
+			Resume:             *resume,
+			InsecureSkipVerify: *insecure,
+			Verify:             *verify,
+		})
 	}
 }
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"path"
+	"strings"
+)
+
+// isAnonymousName reports whether name is one of the conventional anonymous
+// FTP logins.
+func isAnonymousName(name string) bool {
+	name = strings.ToLower(name)
+	return name == "anonymous" || name == "ftp"
+}
+
+// isEmailPassword reports whether password looks like the email address
+// anonymous users are asked to send.
+func isEmailPassword(password string) bool {
+	return strings.Contains(password, "@") && !strings.ContainsAny(password, " \t")
+}
+
+// anonymousUser returns the read-only guest account configured by cfg. If
+// cfg.AnonIncoming is set, that subdirectory is upload only.
+func anonymousUser(cfg Config) *User {
+	u := &User{
+		Name:  "anonymous",
+		Home:  cfg.AnonDir,
+		Perms: PermReadOnly,
+	}
+	if cfg.AnonIncoming != "" {
+		u.WriteOnlyDir = path.Clean("/" + cfg.AnonIncoming)
+	}
+	return u
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator when the username is
+// unknown or the password does not match.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// User is an authenticated FTP account.
+type User struct {
+	Name string
+	// Home is the user's root directory. A relative Home is resolved against
+	// the server's shared directory; an empty Home means the shared directory
+	// itself.
+	Home string
+	// Perms is the set of operations the user may perform.
+	Perms Perm
+	// WriteOnlyDir, if set, is a path relative to Home where the user may
+	// only upload new files, regardless of Perms.
+	WriteOnlyDir string
+}
+
+// PermsAt returns the permissions the user has on the virtual path p.
+func (u *User) PermsAt(p string) Perm {
+	if u.WriteOnlyDir != "" && (p == u.WriteOnlyDir || strings.HasPrefix(p, strings.TrimSuffix(u.WriteOnlyDir, "/")+"/")) {
+		return PermUpload
+	}
+	return u.Perms
+}
+
+// Authenticator verifies USER/PASS credentials.
+type Authenticator interface {
+	Authenticate(username, password string) (*User, error)
+}
+
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 600000
+	hashSaltLen    = 16
+	hashKeyLen     = 32
+)
+
+// HashPassword returns an encoded PBKDF2-SHA256 hash of password suitable for
+// the users file, in the form pbkdf2-sha256$iterations$salt$key.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, hashIterations, hashKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword reports whether password matches an encoded hash produced by
+// HashPassword.
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+type fileUser struct {
+	name  string
+	hash  string
+	home  string
+	perms Perm
+}
+
+// FileAuthenticator checks credentials against a users file. Each non-empty
+// line not starting with '#' has the form:
+//
+//	username:hash[:home[:perms]]
+//
+// where hash is produced by HashPassword, home is the user's root directory
+// (see User.Home) and perms is anything accepted by ParsePerm or the name of
+// a group. Users without perms get PermFull. Groups are declared on their own
+// line as:
+//
+//	@group:perms
+type FileAuthenticator struct {
+	users map[string]fileUser
+}
+
+// NewFileAuthenticator loads the users file at path.
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]fileUser)
+	groups := make(map[string]Perm)
+	// Users may reference groups declared further down the file, so group
+	// names are resolved once everything has been read.
+	userGroups := make(map[string]string)
+	userLines := make(map[string]int)
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+
+		if strings.HasPrefix(fields[0], "@") {
+			if len(fields) != 2 || len(fields[0]) < 2 {
+				return nil, fmt.Errorf("%s:%d: expected @group:perms", path, lineNo)
+			}
+			if _, dup := groups[fields[0]]; dup {
+				return nil, fmt.Errorf("%s:%d: duplicate group %q", path, lineNo, fields[0])
+			}
+			perms, err := ParsePerm(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			groups[fields[0]] = perms
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 4 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash[:home[:perms]]", path, lineNo)
+		}
+		if _, dup := users[fields[0]]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", path, lineNo, fields[0])
+		}
+		u := fileUser{name: fields[0], hash: fields[1], perms: PermFull}
+		if len(fields) >= 3 {
+			u.home = fields[2]
+		}
+		if len(fields) == 4 && fields[3] != "" {
+			if strings.HasPrefix(fields[3], "@") {
+				userGroups[u.name] = fields[3]
+			} else {
+				perms, err := ParsePerm(fields[3])
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+				}
+				u.perms = perms
+			}
+		}
+		users[u.name] = u
+		userLines[u.name] = lineNo
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, group := range userGroups {
+		perms, ok := groups[group]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown group %q", path, userLines[name], group)
+		}
+		u := users[name]
+		u.perms = perms
+		users[name] = u
+	}
+	return &FileAuthenticator{users: users}, nil
+}
+
+// dummyHash is checked for unknown users so that they take as long to reject
+// as a wrong password, which would otherwise reveal which usernames exist.
+var dummyHash = fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, hashSaltLen)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, hashKeyLen)))
+
+func (a *FileAuthenticator) Authenticate(username, password string) (*User, error) {
+	u, ok := a.users[username]
+	if !ok {
+		verifyPassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if !verifyPassword(u.hash, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return &User{Name: u.name, Home: u.home, Perms: u.perms}, nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$600000$") {
+		t.Errorf("hash %q does not start with the scheme and iterations", hash)
+	}
+	if !verifyPassword(hash, "secret") {
+		t.Error("the right password was rejected")
+	}
+	for _, wrong := range []string{"", "Secret", "secret ", "secre"} {
+		if verifyPassword(hash, wrong) {
+			t.Errorf("password %q was accepted", wrong)
+		}
+	}
+
+	again, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == hash {
+		t.Error("two hashes of the same password are equal; salt missing?")
+	}
+}
+
+func TestVerifyPasswordMalformed(t *testing.T) {
+	// A valid hash of "pw" with 1 iteration, to vary one part at a time
+	const salt, key = "AAAAAAAAAAAAAAAAAAAAAA", "ww4SWtYWsvVgc6ynC/DAAJF37KXiVTJjocjejhxj1oQ"
+	if !verifyPassword("pbkdf2-sha256$1$"+salt+"$"+key, "pw") {
+		t.Fatal("reference hash rejected")
+	}
+
+	for _, encoded := range []string{
+		"",
+		"pw",
+		"pbkdf2-sha256$1$" + salt,
+		"pbkdf2-sha256$1$" + salt + "$" + key + "$extra",
+		"pbkdf2-sha1$1$" + salt + "$" + key,
+		"pbkdf2-sha256$0$" + salt + "$" + key,
+		"pbkdf2-sha256$-1$" + salt + "$" + key,
+		"pbkdf2-sha256$x$" + salt + "$" + key,
+		"pbkdf2-sha256$1$!!$" + key,
+		"pbkdf2-sha256$1$" + salt + "$",
+		"pbkdf2-sha256$1$" + salt + "$!!",
+	} {
+		if verifyPassword(encoded, "pw") {
+			t.Errorf("verifyPassword(%q) accepted", encoded)
+		}
+	}
+}
+
+// writeUsersFile writes content to a users file and returns its path.
+func writeUsersFile(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestNewFileAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]fileUser
+		err     string
+	}{
+		{
+			name: "defaults",
+			content: `# comment
+alice:h1
+
+bob:h2:home/bob
+`,
+			want: map[string]fileUser{
+				"alice": {name: "alice", hash: "h1", perms: PermFull},
+				"bob":   {name: "bob", hash: "h2", home: "home/bob", perms: PermFull},
+			},
+		},
+		{
+			name:    "perms",
+			content: "alice:h1::read-only\nbob:h2:/srv:list,upload\ncarol:h3:x:\n",
+			want: map[string]fileUser{
+				"alice": {name: "alice", hash: "h1", perms: PermReadOnly},
+				"bob":   {name: "bob", hash: "h2", home: "/srv", perms: PermList | PermUpload},
+				"carol": {name: "carol", hash: "h3", home: "x", perms: PermFull},
+			},
+		},
+		{
+			name:    "groups",
+			content: "@staff:full\n  @guests:Read-Only  \nalice:h1::@staff\nbob:h2:pub:@guests\n",
+			want: map[string]fileUser{
+				"alice": {name: "alice", hash: "h1", perms: PermFull},
+				"bob":   {name: "bob", hash: "h2", home: "pub", perms: PermReadOnly},
+			},
+		},
+		{
+			name:    "forward group reference",
+			content: "alice:h1::@guests\n@guests:read-only\n@staff:list,mkdir\nbob:h2::@staff\n",
+			want: map[string]fileUser{
+				"alice": {name: "alice", hash: "h1", perms: PermReadOnly},
+				"bob":   {name: "bob", hash: "h2", perms: PermList | PermMkdir},
+			},
+		},
+		{name: "unknown group", content: "alice:h1\nbob:h2::@nobody\n", err: "users:2: unknown group \"@nobody\""},
+		{name: "duplicate user", content: "alice:h1\nalice:h2\n", err: "users:2: duplicate user \"alice\""},
+		{name: "duplicate group", content: "@g:full\n@g:none\n", err: "users:2: duplicate group \"@g\""},
+		{name: "group without perms", content: "@g\n", err: "users:1: expected @group:perms"},
+		{name: "group with extra field", content: "@g:full:x\n", err: "users:1: expected @group:perms"},
+		{name: "empty group name", content: "@:full\n", err: "users:1: expected @group:perms"},
+		{name: "bad group perms", content: "@g:fly\n", err: "users:1: unknown permission \"fly\""},
+		{name: "missing hash", content: "alice\n", err: "users:1: expected username:hash"},
+		{name: "empty hash", content: "alice:\n", err: "users:1: expected username:hash"},
+		{name: "empty name", content: ":h1\n", err: "users:1: expected username:hash"},
+		{name: "too many fields", content: "alice:h1:home:full:x\n", err: "users:1: expected username:hash"},
+		{name: "bad perms", content: "# c\nalice:h1::list,fly\n", err: "users:2: unknown permission \"fly\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewFileAuthenticator(writeUsersFile(t, tt.content))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(a.users) != len(tt.want) {
+				t.Errorf("got %d users, want %d", len(a.users), len(tt.want))
+			}
+			for name, want := range tt.want {
+				if got := a.users[name]; got != want {
+					t.Errorf("user %s: got %+v, want %+v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileAuthenticatorAuthenticate(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewFileAuthenticator(writeUsersFile(t, "alice:"+hash+":home:read-only\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := a.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "alice" || u.Home != "home" || u.Perms != PermReadOnly {
+		t.Errorf("got %+v", u)
+	}
+
+	start := time.Now()
+	if _, err := a.Authenticate("alice", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("wrong password: %v", err)
+	}
+	wrongPassword := time.Since(start)
+
+	start = time.Now()
+	if _, err := a.Authenticate("mallory", "secret"); err != ErrInvalidCredentials {
+		t.Errorf("unknown user: %v", err)
+	}
+	unknownUser := time.Since(start)
+
+	// Both run the full key derivation; a generous margin keeps this stable
+	if unknownUser < wrongPassword/4 {
+		t.Errorf("unknown user rejected in %v, wrong password in %v; usernames can be told apart", unknownUser, wrongPassword)
+	}
+}
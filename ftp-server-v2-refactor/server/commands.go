@@ -0,0 +1,266 @@
+package server
+
+import "fmt"
+
+// argRule says whether a command takes an argument.
+type argRule int
+
+const (
+	argNone argRule = iota
+	argOptional
+	argRequired
+)
+
+// command describes an FTP command: what the session checks before running
+// it and how HELP presents it.
+type command struct {
+	name string
+	// usage is what follows the name in HELP, e.g. "<path>"
+	usage string
+	help  string
+	// auth requires a logged in user
+	auth bool
+	args argRule
+	// perm is the permission needed on the path the command acts on, if any
+	perm Perm
+	// data marks commands that transfer over a data connection
+	data bool
+	// duringTransfer marks the commands answered while a transfer runs;
+	// others wait for it to finish
+	duringTransfer bool
+	// needsTLS refuses the command on a clear control connection when
+	// Config.RequireTLS is set
+	needsTLS bool
+	// notAfterEpsvAll marks the data connection commands other than EPSV,
+	// refused once the client has sent EPSV ALL (RFC 2428)
+	notAfterEpsvAll bool
+	run             func(s *Session, arg string)
+}
+
+// commands maps command names to their descriptions; commandNames keeps the
+// order of commandTable for HELP.
+var (
+	commands     = map[string]*command{}
+	commandNames []string
+)
+
+func init() {
+	for _, c := range commandTable {
+		commands[c.name] = c
+		commandNames = append(commandNames, c.name)
+	}
+}
+
+// commandTable lists every command the server understands. A new command only
+// needs an entry here.
+var commandTable = []*command{
+	// Session
+	{name: "USER", usage: "<name>", help: "start a login", args: argRequired, needsTLS: true,
+		run: func(s *Session, arg string) {
+			s.user = nil
+			handleUserCommand(s.writer, arg, s.cfg, &s.username)
+		}},
+	{name: "PASS", usage: "<password>", help: "finish a login", args: argOptional,
+		run: func(s *Session, arg string) {
+			// Without a pending USER the reply is 503 and the session,
+			// logged in or not, stays as it is
+			if s.username == "" {
+				handlePassCommand(s.writer, arg, s.cfg, &s.username, &s.fsys, s.conn.RemoteAddr())
+				return
+			}
+			s.user = handlePassCommand(s.writer, arg, s.cfg, &s.username, &s.fsys, s.conn.RemoteAddr())
+			s.currentDir = "/"
+		}},
+	{name: "AUTH", usage: "TLS", help: "upgrade the control connection to TLS", args: argRequired,
+		run: (*Session).startTLS},
+	{name: "PBSZ", usage: "0", help: "set the protection buffer size", args: argRequired,
+		run: func(s *Session, arg string) {
+			handlePbszCommand(s.writer, arg, s.tlsActive, &s.pbszSet)
+		}},
+	{name: "PROT", usage: "P|C", help: "protect data connections or not", args: argRequired,
+		run: func(s *Session, arg string) {
+			handleProtCommand(s.writer, arg, s.cfg, s.pbszSet, s.cfg.RequireTLS || s.implicitTLS, &s.data)
+		}},
+	{name: "FEAT", help: "list extensions",
+		run: func(s *Session, arg string) {
+			handleFeatCommand(s.writer, s.cfg, s.facts, s.hashAlg)
+		}},
+	{name: "OPTS", usage: "UTF8 ON|MLST <facts>|MODE Z LEVEL <n>|HASH <alg>", help: "set options", args: argRequired,
+		run: func(s *Session, arg string) {
+			handleOptsCommand(s.writer, arg, s.cfg, &s.facts, &s.data, &s.hashAlg)
+		}},
+	{name: "SYST", help: "show the system type",
+		run: func(s *Session, arg string) {
+			s.reply("215 UNIX Type: L8")
+		}},
+	{name: "NOOP", help: "do nothing", duringTransfer: true,
+		run: func(s *Session, arg string) {
+			s.reply("200 NOOP ok")
+		}},
+	{name: "HELP", usage: "[command]", help: "list commands or describe one", args: argOptional,
+		run: func(s *Session, arg string) {
+			handleHelpCommand(s.writer, arg)
+		}},
+	{name: "STAT", usage: "[path]", help: "show transfer or session status, or list path", auth: true, args: argOptional, duringTransfer: true,
+		run: func(s *Session, arg string) {
+			handleStatCommand(s.writer, arg, s.user, s.fsys, s.currentDir, s.current, s.transferType, s.tlsActive, s.data.tlsConfig != nil)
+		}},
+	{name: "QUIT", help: "log out",
+		run: func(s *Session, arg string) {
+			s.reply("221 Goodbye")
+			s.closing = true
+		}},
+
+	// Directories
+	{name: "PWD", help: "show the working directory", auth: true,
+		run: func(s *Session, arg string) {
+			s.reply(fmt.Sprintf("257 %s is the current directory", quotePath(s.currentDir)))
+		}},
+	{name: "CWD", usage: "<dir>", help: "change the working directory", auth: true, args: argRequired,
+		run: func(s *Session, arg string) {
+			handleCwdCommand(s.writer, arg, s.fsys, &s.currentDir)
+		}},
+	{name: "CDUP", help: "go to the parent directory", auth: true,
+		run: func(s *Session, arg string) {
+			handleCdupCommand(s.writer, &s.currentDir)
+		}},
+	{name: "MKD", usage: "<dir>", help: "make a directory", auth: true, args: argRequired, perm: PermMkdir,
+		run: func(s *Session, arg string) {
+			handleMkdCommand(s.writer, arg, s.fsys, s.currentDir)
+		}},
+	{name: "RMD", usage: "<dir>", help: "remove an empty directory", auth: true, args: argRequired, perm: PermDelete,
+		run: func(s *Session, arg string) {
+			handleRmdCommand(s.writer, arg, s.fsys, s.currentDir)
+		}},
+	{name: "DELE", usage: "<path>", help: "delete a file", auth: true, args: argRequired, perm: PermDelete,
+		run: func(s *Session, arg string) {
+			handleDeleCommand(s.writer, arg, s.fsys, s.currentDir)
+		}},
+	{name: "RNFR", usage: "<path>", help: "rename from, followed by RNTO", auth: true, args: argRequired, perm: PermRename,
+		run: func(s *Session, arg string) {
+			handleRnfrCommand(s.writer, arg, s.fsys, s.currentDir, &s.renameFrom)
+		}},
+	{name: "RNTO", usage: "<path>", help: "rename to", auth: true, args: argRequired, perm: PermRename,
+		run: func(s *Session, arg string) {
+			handleRntoCommand(s.writer, arg, s.user, s.fsys, s.currentDir, s.pendingRename)
+		}},
+
+	// Listings and file information
+	{name: "LIST", usage: "[path]", help: "list a directory", auth: true, args: argOptional, perm: PermList, data: true,
+		run: func(s *Session, arg string) {
+			s.current = handleListCommand(s.writer, arg, s.cfg.ListFormat, s.fsys, s.currentDir, &s.data)
+		}},
+	{name: "NLST", usage: "[path]", help: "list names only", auth: true, args: argOptional, perm: PermList, data: true,
+		run: func(s *Session, arg string) {
+			s.current = handleNlstCommand(s.writer, arg, s.fsys, s.currentDir, &s.data)
+		}},
+	{name: "MLSD", usage: "[dir]", help: "list a directory, machine readable", auth: true, args: argOptional, perm: PermList, data: true,
+		run: func(s *Session, arg string) {
+			s.current = handleMlsdCommand(s.writer, arg, s.user, s.fsys, s.currentDir, &s.data, s.facts)
+		}},
+	{name: "MLST", usage: "[path]", help: "describe a file, machine readable", auth: true, args: argOptional, perm: PermList,
+		run: func(s *Session, arg string) {
+			handleMlstCommand(s.writer, arg, s.user, s.fsys, s.currentDir, s.facts)
+		}},
+	{name: "SIZE", usage: "<path>", help: "show the size of a file", auth: true, args: argRequired, perm: PermList,
+		run: func(s *Session, arg string) {
+			handleSizeCommand(s.writer, arg, s.fsys, s.currentDir)
+		}},
+	{name: "MDTM", usage: "<path>", help: "show the modification time of a file", auth: true, args: argRequired, perm: PermList,
+		run: func(s *Session, arg string) {
+			handleMdtmCommand(s.writer, arg, s.fsys, s.currentDir)
+		}},
+	{name: "MFMT", usage: "<YYYYMMDDHHMMSS> <path>", help: "set the modification time of a file", auth: true, args: argRequired, perm: PermOverwrite,
+		run: func(s *Session, arg string) {
+			handleMfmtCommand(s.writer, arg, s.fsys, s.currentDir)
+		}},
+	{name: "HASH", usage: "<path>", help: "hash a file", auth: true, args: argRequired, perm: PermDownload,
+		run: func(s *Session, arg string) {
+			handleHashCommand(s.writer, arg, s.fsys, s.currentDir, s.hashAlg, s.hashRange)
+			s.hashRange = nil
+		}},
+	{name: "RANG", usage: "<first> <last>", help: "select the bytes the next HASH covers", auth: true, args: argRequired,
+		run: func(s *Session, arg string) {
+			handleRangCommand(s.writer, arg, &s.hashRange)
+		}},
+	xHashCommand("XCRC"),
+	xHashCommand("XMD5"),
+	xHashCommand("XSHA1"),
+	xHashCommand("XSHA256"),
+
+	// Transfers
+	{name: "TYPE", usage: "A|I", help: "set ASCII or binary transfers", auth: true, args: argRequired,
+		run: func(s *Session, arg string) {
+			handleTypeCommand(s.writer, arg, &s.transferType)
+		}},
+	{name: "MODE", usage: "S|Z", help: "set stream or compressed transfers", auth: true, args: argRequired,
+		run: func(s *Session, arg string) {
+			handleModeCommand(s.writer, arg, s.cfg, &s.data)
+		}},
+	{name: "STRU", usage: "F", help: "set the file structure", auth: true, args: argRequired,
+		run: func(s *Session, arg string) {
+			handleStruCommand(s.writer, arg)
+		}},
+	{name: "PASV", help: "open a passive data connection", auth: true, notAfterEpsvAll: true,
+		run: func(s *Session, arg string) {
+			handlePasvCommand(s.writer, s.cfg, &s.data, s.conn.LocalAddr())
+		}},
+	{name: "EPSV", usage: "[1|2|ALL]", help: "open an extended passive data connection", auth: true, args: argOptional,
+		run: func(s *Session, arg string) {
+			handleEpsvCommand(s.writer, arg, s.cfg, &s.data, s.conn.LocalAddr(), &s.epsvAll)
+		}},
+	{name: "PORT", usage: "h1,h2,h3,h4,p1,p2", help: "open an active data connection", auth: true, args: argRequired, notAfterEpsvAll: true,
+		run: func(s *Session, arg string) {
+			handlePortCommand(s.writer, arg, &s.data, s.conn.RemoteAddr())
+		}},
+	{name: "EPRT", usage: "|proto|addr|port|", help: "open an extended active data connection", auth: true, args: argRequired, notAfterEpsvAll: true,
+		run: func(s *Session, arg string) {
+			handleEprtCommand(s.writer, arg, &s.data, s.conn.RemoteAddr())
+		}},
+	{name: "REST", usage: "<offset>", help: "restart the next RETR or STOR at offset", auth: true, args: argRequired,
+		run: func(s *Session, arg string) {
+			handleRestCommand(s.writer, arg, &s.restOffset)
+		}},
+	{name: "RETR", usage: "<path>", help: "download a file", auth: true, args: argRequired, perm: PermDownload, data: true,
+		run: func(s *Session, arg string) {
+			s.current = handleRetrCommand(s.writer, arg, s.fsys, s.currentDir, &s.data, s.transferType, s.restOffset)
+			s.restOffset = 0
+		}},
+	{name: "STOR", usage: "<path>", help: "upload a file", auth: true, args: argRequired, perm: PermUpload, data: true,
+		run: func(s *Session, arg string) {
+			s.current = handleStorCommand(s.writer, arg, s.user, s.fsys, s.currentDir, &s.data, s.transferType, false, s.restOffset)
+			s.restOffset = 0
+		}},
+	{name: "APPE", usage: "<path>", help: "append to a file", auth: true, args: argRequired, perm: PermUpload, data: true,
+		run: func(s *Session, arg string) {
+			s.current = handleStorCommand(s.writer, arg, s.user, s.fsys, s.currentDir, &s.data, s.transferType, true, s.restOffset)
+			s.restOffset = 0
+		}},
+	{name: "STOU", usage: "[name]", help: "upload under a unique name", auth: true, args: argOptional, perm: PermUpload, data: true,
+		run: func(s *Session, arg string) {
+			// A unique name is always a new file, so a REST offset has
+			// nothing to resume and must not carry over
+			s.current = handleStouCommand(s.writer, arg, s.fsys, s.currentDir, &s.data, s.transferType)
+			s.restOffset = 0
+		}},
+	{name: "ABOR", help: "abort the running transfer", duringTransfer: true,
+		run: func(s *Session, arg string) {
+			handleAborCommand(s.writer, s.current, &s.data)
+			s.current = nil
+		}},
+}
+
+// xHashCommand describes one of the non-standard checksum commands.
+func xHashCommand(name string) *command {
+	return &command{
+		name:  name,
+		usage: "<path> [<first> <last>]",
+		help:  xHashCommands[name] + " checksum of a file",
+		auth:  true,
+		args:  argRequired,
+		perm:  PermDownload,
+		run: func(s *Session, arg string) {
+			handleXHashCommand(s.writer, name, arg, s.fsys, s.currentDir)
+		},
+	}
+}
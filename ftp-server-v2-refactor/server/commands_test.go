@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newTestSession returns a session for user on fsys whose replies are
+// collected in the returned buffer. No client is connected.
+func newTestSession(t *testing.T, cfg Config, user *User, fsys FileSystem) (*Session, *bytes.Buffer) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	s := newSession(conn, cfg, false, nil)
+	var out bytes.Buffer
+	s.writer = bufio.NewWriter(&out)
+	s.user = user
+	s.fsys = fsys
+	t.Cleanup(s.data.reset)
+	return s, &out
+}
+
+// run dispatches line and returns the reply.
+func run(s *Session, out *bytes.Buffer, line string) string {
+	out.Reset()
+	s.dispatch(line)
+	return strings.TrimSpace(out.String())
+}
+
+func TestHashNeedsDownload(t *testing.T) {
+	fsys := NewMemFileSystem()
+	fsys.WriteFile("/secret.txt", []byte("AB"))
+	s, out := newTestSession(t, Config{}, &User{Name: "lister", Perms: PermList}, fsys)
+
+	if got := run(s, out, "SIZE secret.txt"); !strings.HasPrefix(got, "213") {
+		t.Fatalf("SIZE: reply %q, want 213", got)
+	}
+	for _, line := range []string{
+		"RETR secret.txt",
+		"HASH secret.txt",
+		"XCRC secret.txt 0 0",
+		"XMD5 secret.txt 1 1",
+		"XSHA1 secret.txt",
+		"XSHA256 secret.txt",
+	} {
+		if got := run(s, out, line); !strings.HasPrefix(got, "550") {
+			t.Errorf("%s: reply %q, want 550", line, got)
+		}
+	}
+
+	s.user.Perms = PermReadOnly
+	if got := run(s, out, "XCRC secret.txt 0 0"); !strings.HasPrefix(got, "250") {
+		t.Errorf("XCRC with download permission: reply %q, want 250", got)
+	}
+}
+
+func TestDataCommandsNeedLogin(t *testing.T) {
+	s, out := newTestSession(t, Config{}, nil, nil)
+	for _, line := range []string{"PASV", "EPSV", "EPSV ALL", "PORT 127,0,0,1,4,1", "EPRT |1|127.0.0.1|1025|"} {
+		if got := run(s, out, line); !strings.HasPrefix(got, "530") {
+			t.Errorf("%s before login: reply %q, want 530", line, got)
+		}
+	}
+	if s.data.listener != nil || s.epsvAll {
+		t.Error("a data command changed the session before login")
+	}
+}
+
+func TestPassWithoutUserKeepsLogin(t *testing.T) {
+	cfg := Config{
+		Auth:       testAuth{},
+		FileSystem: func(*User) (FileSystem, error) { return NewMemFileSystem(), nil },
+		Logger:     log.New(io.Discard, "", 0),
+	}
+	s, out := newTestSession(t, cfg, nil, nil)
+
+	run(s, out, "USER test")
+	if got := run(s, out, "PASS secret"); !strings.HasPrefix(got, "230") {
+		t.Fatalf("login: reply %q", got)
+	}
+	for range 2 {
+		if got := run(s, out, "PASS secret"); !strings.HasPrefix(got, "503") {
+			t.Errorf("PASS without USER: reply %q, want 503", got)
+		}
+	}
+	if got := run(s, out, "PWD"); !strings.HasPrefix(got, "257") {
+		t.Errorf("PWD after PASS without USER: reply %q, want 257", got)
+	}
+}
+
+func TestStouClearsRestOffset(t *testing.T) {
+	fsys := NewMemFileSystem()
+	s, out := newTestSession(t, Config{}, &User{Name: "test", Perms: PermFull}, fsys)
+
+	if got := run(s, out, "REST 5"); !strings.HasPrefix(got, "350") {
+		t.Fatalf("REST: reply %q", got)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.data.setPassive(ln)
+	addr := ln.Addr().String()
+	if got := run(s, out, "STOU"); !strings.HasPrefix(got, "150") {
+		t.Fatalf("STOU: reply %q", got)
+	}
+	sendUpload(t, addr, "data")
+	if reply := <-s.current.done; !strings.HasPrefix(reply, "226") {
+		t.Fatalf("STOU: %q", reply)
+	}
+	s.current = nil
+	if s.restOffset != 0 {
+		t.Errorf("REST offset %d still pending after STOU", s.restOffset)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	s, out := newTestSession(t, Config{}, nil, nil)
+	tests := []struct{ line, reply string }{
+		{"HELP RETR", "214 Syntax: RETR <path>"},
+		{"HELP retr", "214 Syntax: RETR <path>"},
+		{"HELP BOGUS", "501 Unknown command BOGUS"},
+	}
+	for _, tt := range tests {
+		if got := run(s, out, tt.line); !strings.HasPrefix(got, tt.reply) {
+			t.Errorf("%s: reply %q, want %q", tt.line, got, tt.reply)
+		}
+	}
+	if got := run(s, out, "HELP"); !strings.HasPrefix(got, "214-") || !strings.HasSuffix(got, "214 End of HELP") {
+		t.Errorf("HELP: reply %q", got)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dataConnTimeout bounds how long we wait for the data connection to be
+// established once a transfer has been announced with 150, unless
+// Config.DataTimeout says otherwise.
+const dataConnTimeout = 30 * time.Second
+
+// dataChannel is the data connection negotiated for the next transfer. In
+// passive mode (PASV) listener is waiting for the client to connect; in active
+// mode (PORT/EPRT) activeAddr is where we connect back to.
+type dataChannel struct {
+	listener   net.Listener
+	activeAddr *net.TCPAddr
+
+	// tlsConfig is set after PROT P; data connections are then protected
+	// with TLS. It outlives reset, as the protection level applies to every
+	// following transfer.
+	tlsConfig *tls.Config
+
+	// compress is set after MODE Z; data is then sent as a deflate stream
+	// at compressLevel. Like tlsConfig these outlive reset.
+	compress      bool
+	compressLevel int
+
+	// timeout bounds how long opening a connection may take, 0 meaning
+	// dataConnTimeout. It and logger are set for the session.
+	timeout time.Duration
+	logger  *log.Logger
+
+	// peerIP is the address of the client on the control connection, set
+	// for the session. Passive connections from other hosts are refused.
+	peerIP net.IP
+}
+
+// ready reports whether PASV, PORT or EPRT has been issued.
+func (d *dataChannel) ready() bool {
+	return d.listener != nil || d.activeAddr != nil
+}
+
+// setPassive replaces any pending data channel with a passive listener.
+func (d *dataChannel) setPassive(ln net.Listener) {
+	d.reset()
+	d.listener = ln
+}
+
+// setActive replaces any pending data channel with an active address.
+func (d *dataChannel) setActive(addr *net.TCPAddr) {
+	d.reset()
+	d.activeAddr = addr
+}
+
+// take hands the negotiated channel over to a transfer, so every transfer
+// needs a fresh PASV or PORT.
+func (d *dataChannel) take() dataChannel {
+	t := *d
+	d.listener = nil
+	d.activeAddr = nil
+	return t
+}
+
+// open establishes the data connection, giving up when ctx is cancelled. The
+// negotiated channel is used up whether or not this succeeds.
+func (d *dataChannel) open(ctx context.Context) (net.Conn, error) {
+	defer d.reset()
+
+	timeout := d.timeout
+	if timeout == 0 {
+		timeout = dataConnTimeout
+	}
+	var conn net.Conn
+	var err error
+	switch {
+	case d.listener != nil:
+		ln := d.listener
+		stop := context.AfterFunc(ctx, func() { ln.Close() })
+		defer stop()
+		if tl, ok := ln.(*net.TCPListener); ok {
+			tl.SetDeadline(time.Now().Add(timeout))
+		}
+		conn, err = acceptFrom(ln, d.peerIP, d.logger)
+	case d.activeAddr != nil:
+		dialer := net.Dialer{Timeout: timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", d.activeAddr.String())
+	default:
+		err = errors.New("no data connection")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.tlsConfig == nil {
+		return conn, nil
+	}
+	// We are always the TLS server, even when we dialled in active mode
+	tlsConn := tls.Server(conn, d.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// acceptFrom returns the first connection to ln coming from ip, closing
+// those from other hosts: a third party that connects to the advertised port
+// first must not get to read or inject the data (port theft, RFC 2577). A
+// nil ip accepts any host.
+func acceptFrom(ln net.Listener, ip net.IP, logger *log.Logger) (net.Conn, error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil || ip == nil || connIP(conn.RemoteAddr()).Equal(ip) {
+			return conn, err
+		}
+		logf(logger, "Rejected data connection from %s, expected %s", conn.RemoteAddr(), ip)
+		conn.Close()
+	}
+}
+
+// reset drops the pending data channel, closing any passive listener.
+func (d *dataChannel) reset() {
+	if d.listener != nil {
+		d.listener.Close()
+		d.listener = nil
+	}
+	d.activeAddr = nil
+}
+
+// PortRange is an inclusive range of TCP ports. The zero value means any
+// free port.
+type PortRange struct {
+	Min, Max int
+}
+
+// ParsePortRange parses "min-max", or a single port.
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		hi = lo
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// listenPassive opens a passive data listener on host, using a port from r if
+// one is configured. Ports are tried from a random starting point so
+// concurrent sessions don't all race for the first one.
+func listenPassive(network, host string, r PortRange) (net.Listener, error) {
+	if r.Min == 0 {
+		return net.Listen(network, net.JoinHostPort(host, "0"))
+	}
+
+	n := r.Max - r.Min + 1
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		port := r.Min + (start+i)%n
+		ln, err := net.Listen(network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in %d-%d", r.Min, r.Max)
+}
+
+// passiveIP returns the IPv4 address advertised in PASV replies. It is nil if
+// there is no IPv4 address to advertise.
+func passiveIP(advertise string, local net.Addr) (net.IP, error) {
+	switch advertise {
+	case "":
+		// Only fall back to the LAN address for IPv4 clients
+		if connIP(local).To4() == nil {
+			return nil, nil
+		}
+		return getLANIP(), nil
+	case "control":
+		return connIP(local).To4(), nil
+	}
+
+	if ip := net.ParseIP(advertise); ip != nil {
+		return ip.To4(), nil
+	}
+	// A hostname is looked up every time so dynamic DNS keeps working
+	ips, err := net.LookupIP(advertise)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassiveRejectsOtherHosts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &dataChannel{
+		timeout: 5 * time.Second,
+		logger:  log.New(io.Discard, "", 0),
+		peerIP:  net.IPv4(127, 0, 0, 1),
+	}
+	data.setPassive(ln)
+	addr := ln.Addr().String()
+
+	opened := make(chan net.Conn)
+	go func() {
+		conn, err := data.open(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- conn
+	}()
+
+	// Another host, here another loopback address, gets there first
+	thief := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	conn, err := thief.Dial("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot connect from 127.0.0.2: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection from another host was kept open")
+	}
+	conn.Close()
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-opened
+	if server == nil {
+		t.Fatal("the client's own connection was not accepted")
+	}
+	defer server.Close()
+	if got := connIP(server.RemoteAddr()); !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("accepted a connection from %s", got)
+	}
+}
+
+func TestConnHostKeepsZone(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 21}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 21}, "2001:db8::1"},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 21, Zone: "eth0"}, "fe80::1%eth0"},
+	}
+	for _, tt := range tests {
+		if got := connHost(tt.addr); got != tt.want {
+			t.Errorf("connHost(%v) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestEpsvLinkLocal(t *testing.T) {
+	local := linkLocalAddr(t)
+	var out bytes.Buffer
+	data := &dataChannel{}
+	defer data.reset()
+	var epsvAll bool
+	handleEpsvCommand(bufio.NewWriter(&out), "", Config{Logger: log.New(io.Discard, "", 0)}, data, local, &epsvAll)
+	if got := strings.TrimSpace(out.String()); !strings.HasPrefix(got, "229") {
+		t.Errorf("EPSV on %v: reply %q, want 229", local, got)
+	}
+}
+
+// linkLocalAddr returns an IPv6 link-local address of this host with its
+// zone, skipping the test if there is none.
+func linkLocalAddr(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				return &net.TCPAddr{IP: ipnet.IP, Port: 21, Zone: iface.Name}
+			}
+		}
+	}
+	t.Skip("no IPv6 link-local address")
+	return nil
+}
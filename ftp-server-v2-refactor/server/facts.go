@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// mlstFacts are the MLST/MLSD facts we support (RFC 3659), in FEAT order.
+var mlstFacts = []string{"type", "size", "modify", "perm", "unique"}
+
+// parseMlstFacts parses the argument of OPTS MLST, e.g. "type;size;". Unknown
+// facts are ignored.
+func parseMlstFacts(arg string) []string {
+	var facts []string
+	for _, f := range strings.Split(arg, ";") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		for _, known := range mlstFacts {
+			if f == known {
+				facts = append(facts, f)
+				break
+			}
+		}
+	}
+	return facts
+}
+
+// mlstFeature returns the MLST line of the FEAT reply, marking the facts that
+// are currently selected with '*'.
+func mlstFeature(selected []string) string {
+	var b strings.Builder
+	b.WriteString("MLST ")
+	for _, f := range mlstFacts {
+		b.WriteString(f)
+		if slices.Contains(selected, f) {
+			b.WriteByte('*')
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// formatFacts renders the selected facts for one file as used by MLST and
+// MLSD, e.g. "type=file;size=42;modify=20240102030405;".
+func formatFacts(info os.FileInfo, perms Perm, selected []string) string {
+	var b strings.Builder
+	for _, f := range selected {
+		switch f {
+		case "type":
+			typ := "file"
+			if info.IsDir() {
+				typ = "dir"
+			}
+			fmt.Fprintf(&b, "type=%s;", typ)
+		case "size":
+			if !info.IsDir() {
+				fmt.Fprintf(&b, "size=%d;", info.Size())
+			}
+		case "modify":
+			fmt.Fprintf(&b, "modify=%s;", formatFTPTime(info.ModTime()))
+		case "perm":
+			fmt.Fprintf(&b, "perm=%s;", permFact(info, perms))
+		case "unique":
+			if u := uniqueFact(info); u != "" {
+				fmt.Fprintf(&b, "unique=%s;", u)
+			}
+		}
+	}
+	return b.String()
+}
+
+// permFact maps a user's permissions onto the MLST "perm" fact letters.
+func permFact(info os.FileInfo, perms Perm) string {
+	var b strings.Builder
+	if info.IsDir() {
+		// Entering a directory is always allowed
+		b.WriteByte('e')
+		if perms.Has(PermList) {
+			b.WriteByte('l')
+		}
+		if perms.Has(PermUpload) {
+			b.WriteByte('c')
+		}
+		if perms.Has(PermMkdir) {
+			b.WriteByte('m')
+		}
+		if perms.Has(PermDelete) {
+			b.WriteString("dp")
+		}
+	} else {
+		if perms.Has(PermDownload) {
+			b.WriteByte('r')
+		}
+		if perms.Has(PermOverwrite) {
+			b.WriteString("aw")
+		}
+		if perms.Has(PermDelete) {
+			b.WriteByte('d')
+		}
+	}
+	if perms.Has(PermRename) {
+		b.WriteByte('f')
+	}
+	return b.String()
+}
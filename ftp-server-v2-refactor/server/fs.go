@@ -0,0 +1,191 @@
+package server
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FileSystem is the tree a session serves. Handlers only ever reach files
+// through it, so a server can serve something other than a host directory.
+//
+// Names are cleaned virtual paths rooted at "/", as returned by resolvePath.
+// Errors should wrap fs.ErrNotExist, fs.ErrExist and fs.ErrPermission where
+// they apply, as handlers map those to replies.
+type FileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Open(name string) (File, error)
+	// OpenFile takes the os.O_* flags.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	// Rename replaces newname if it exists and is not a directory.
+	Rename(oldname, newname string) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// File is an open file of a FileSystem. *os.File satisfies it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// userFileSystem returns the FileSystem served to a logged in user.
+func userFileSystem(cfg Config, user *User) (FileSystem, error) {
+	if cfg.FileSystem != nil {
+		return cfg.FileSystem(user)
+	}
+	home, err := userRoot(cfg.SharedDir, user.Home)
+	if err != nil {
+		return nil, err
+	}
+	return OpenDirFileSystem(home)
+}
+
+// closeFileSystem releases a FileSystem the session is done with.
+func closeFileSystem(fsys FileSystem) {
+	if c, ok := fsys.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// DirFileSystem serves a host directory. Every path is resolved by an
+// os.Root, so neither ".." nor a symbolic link can lead outside the
+// directory; links within it work as usual.
+type DirFileSystem struct {
+	root *os.Root
+}
+
+// OpenDirFileSystem returns a DirFileSystem serving dir. Close it when done.
+func OpenDirFileSystem(dir string) (*DirFileSystem, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DirFileSystem{root}, nil
+}
+
+// Close releases the directory.
+func (d *DirFileSystem) Close() error {
+	return d.root.Close()
+}
+
+// rootName turns a virtual path into the relative name os.Root takes.
+func rootName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return filepath.FromSlash(name)
+}
+
+func (d *DirFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return d.root.Stat(rootName(name))
+}
+
+func (d *DirFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := d.root.Open(rootName(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := f.ReadDir(-1)
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, err
+}
+
+func (d *DirFileSystem) Open(name string) (File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (d *DirFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := d.root.OpenFile(rootName(name), flag, perm)
+	if err != nil {
+		// Don't return a nil *os.File as a non-nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *DirFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	return d.root.Mkdir(rootName(name), perm)
+}
+
+func (d *DirFileSystem) Remove(name string) error {
+	return d.root.Remove(rootName(name))
+}
+
+func (d *DirFileSystem) Rename(oldname, newname string) error {
+	return d.root.Rename(rootName(oldname), rootName(newname))
+}
+
+func (d *DirFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return d.root.Chtimes(rootName(name), atime, mtime)
+}
+
+// ReadOnly wraps fsys so that anything that would change it fails with
+// fs.ErrPermission, whatever the user's permissions say.
+func ReadOnly(fsys FileSystem) FileSystem {
+	return readOnlyFileSystem{fsys}
+}
+
+type readOnlyFileSystem struct {
+	fsys FileSystem
+}
+
+// Close closes the wrapped FileSystem if it needs closing.
+func (r readOnlyFileSystem) Close() error {
+	closeFileSystem(r.fsys)
+	return nil
+}
+
+// writeFlags are the OpenFile flags that could change a file.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+func (r readOnlyFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return r.fsys.Stat(name)
+}
+
+func (r readOnlyFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return r.fsys.ReadDir(name)
+}
+
+func (r readOnlyFileSystem) Open(name string) (File, error) {
+	return r.fsys.Open(name)
+}
+
+func (r readOnlyFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&writeFlags != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return r.fsys.OpenFile(name, flag, perm)
+}
+
+func (r readOnlyFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (r readOnlyFileSystem) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (r readOnlyFileSystem) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrPermission}
+}
+
+func (r readOnlyFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrPermission}
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTraversalTree lays out a served directory next to things a client must
+// never reach:
+//
+//	parent/outside.txt
+//	parent/share-evil/secret.txt
+//	parent/share/           the root that is served
+//	    file.txt
+//	    sub/up          -> ..              (stays inside)
+//	    inner-link      -> file.txt        (stays inside)
+//	    escape-file     -> ../outside.txt
+//	    escape-dir      -> ../share-evil
+//	    abs-link        -> parent/outside.txt, absolute
+//	    dangling        -> ../missing.txt
+func newTraversalTree(t *testing.T) (parent string, fsys *DirFileSystem) {
+	t.Helper()
+	parent = t.TempDir()
+	share := filepath.Join(parent, "share")
+	for _, dir := range []string{share, filepath.Join(share, "sub"), filepath.Join(parent, "share-evil")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(parent, "outside.txt"):              "outside",
+		filepath.Join(parent, "share-evil", "secret.txt"): "secret",
+		filepath.Join(share, "file.txt"):                  "inside",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(share, "sub", "up"):   "..",
+		filepath.Join(share, "inner-link"):  "file.txt",
+		filepath.Join(share, "escape-file"): filepath.Join("..", "outside.txt"),
+		filepath.Join(share, "escape-dir"):  filepath.Join("..", "share-evil"),
+		filepath.Join(share, "abs-link"):    filepath.Join(parent, "outside.txt"),
+		filepath.Join(share, "dangling"):    filepath.Join("..", "missing.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Skipf("symbolic links not supported: %v", err)
+		}
+	}
+
+	fsys, err := OpenDirFileSystem(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fsys.Close() })
+	return parent, fsys
+}
+
+func TestResolvePathStaysBelowRoot(t *testing.T) {
+	tests := []struct {
+		cwd, arg, want string
+	}{
+		{"/", "../../etc/passwd", "/etc/passwd"},
+		{"/sub", "../../../etc/passwd", "/etc/passwd"},
+		{"/", "/../..", "/"},
+		{"/", "a/../../b", "/b"},
+		{"/sub", "./../..//x", "/x"},
+		{"/", "...", "/..."},
+		{"/", "..\\..\\x", "/..\\..\\x"},
+		{"/sub", "", "/sub"},
+	}
+	for _, tt := range tests {
+		if got := resolvePath(tt.cwd, tt.arg); got != tt.want {
+			t.Errorf("resolvePath(%q, %q) = %q, want %q", tt.cwd, tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestDirFileSystemRejectsEscapes(t *testing.T) {
+	parent, fsys := newTraversalTree(t)
+
+	// Each name is what a client might send, relative to "/"
+	escapes := []string{
+		"../outside.txt",
+		"../../etc/passwd",
+		"../share-evil/secret.txt",
+		"escape-file",
+		"escape-dir/secret.txt",
+		"abs-link",
+		"sub/up/escape-file",
+		"dangling",
+	}
+	for _, arg := range escapes {
+		name := resolvePath("/", arg)
+		if f, err := fsys.Open(name); err == nil {
+			f.Close()
+			t.Errorf("Open(%q) succeeded", arg)
+		}
+		if _, err := fsys.Stat(name); err == nil {
+			t.Errorf("Stat(%q) succeeded", arg)
+		}
+		if err := fsys.Chtimes(name, time.Time{}, time.Unix(0, 0)); err == nil {
+			t.Errorf("Chtimes(%q) succeeded", arg)
+		}
+	}
+
+	if _, err := fsys.ReadDir("/escape-dir"); err == nil {
+		t.Error("ReadDir(escape-dir) succeeded")
+	}
+	if f, err := fsys.OpenFile("/escape-dir/new.txt", os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Error("creating escape-dir/new.txt succeeded")
+	}
+	if f, err := fsys.OpenFile("/dangling", os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Error("creating through dangling succeeded")
+	}
+	if err := fsys.Mkdir("/escape-dir/newdir", 0755); err == nil {
+		t.Error("Mkdir(escape-dir/newdir) succeeded")
+	}
+	if err := fsys.Rename("/file.txt", "/escape-dir/stolen.txt"); err == nil {
+		t.Error("Rename into escape-dir succeeded")
+	}
+	if err := fsys.Rename("/escape-dir/secret.txt", "/secret.txt"); err == nil {
+		t.Error("Rename out of escape-dir succeeded")
+	}
+	if err := fsys.Remove("/escape-dir/secret.txt"); err == nil {
+		t.Error("Remove(escape-dir/secret.txt) succeeded")
+	}
+
+	// Nothing outside the root may have changed
+	for _, name := range []string{"outside.txt", filepath.Join("share-evil", "secret.txt")} {
+		info, err := os.Stat(filepath.Join(parent, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if info.ModTime().Equal(time.Unix(0, 0)) {
+			t.Errorf("%s: modification time was changed", name)
+		}
+	}
+	for _, name := range []string{"missing.txt", filepath.Join("share-evil", "new.txt"), filepath.Join("share-evil", "newdir"), filepath.Join("share-evil", "stolen.txt")} {
+		if _, err := os.Lstat(filepath.Join(parent, name)); err == nil {
+			t.Errorf("%s was created outside the root", name)
+		}
+	}
+}
+
+func TestDirFileSystemFollowsInnerLinks(t *testing.T) {
+	_, fsys := newTraversalTree(t)
+
+	for _, name := range []string{"/inner-link", "/sub/up/file.txt", "/sub/up/sub/up/inner-link"} {
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Errorf("Open(%q): %v", name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(f)
+		f.Close()
+		if buf.String() != "inside" {
+			t.Errorf("Open(%q) read %q, want %q", name, buf.String(), "inside")
+		}
+	}
+}
+
+func TestCwdTraversal(t *testing.T) {
+	_, fsys := newTraversalTree(t)
+
+	tests := []struct {
+		cwd, arg string
+		reply    string
+		wantDir  string
+	}{
+		{"/", "sub", "250", "/sub"},
+		{"/sub", "..", "250", "/"},
+		{"/", "..", "250", "/"},
+		{"/sub", "up", "250", "/sub/up"},
+		{"/", "../share-evil", "550", "/"},
+		{"/", "escape-dir", "550", "/"},
+		{"/sub", "../../share-evil", "550", "/sub"},
+		{"/", "/etc", "550", "/"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		dir := tt.cwd
+		handleCwdCommand(w, tt.arg, fsys, &dir)
+		if !strings.HasPrefix(out.String(), tt.reply) || dir != tt.wantDir {
+			t.Errorf("CWD %q from %q: reply %q, dir %q; want %s, dir %q", tt.arg, tt.cwd, strings.TrimSpace(out.String()), dir, tt.reply, tt.wantDir)
+		}
+	}
+}
+
+func TestTransferTraversal(t *testing.T) {
+	_, fsys := newTraversalTree(t)
+	user := &User{Name: "test", Perms: PermFull}
+
+	for _, arg := range []string{"../outside.txt", "../../../etc/passwd", "escape-file", "escape-dir/secret.txt", "abs-link", "up/escape-file"} {
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		if tr := handleRetrCommand(w, arg, fsys, "/sub", newPassiveChannel(t), "I", 0); tr != nil {
+			t.Errorf("RETR %q started a transfer: %s", arg, <-tr.done)
+		}
+		if !strings.HasPrefix(out.String(), "550") {
+			t.Errorf("RETR %q: reply %q, want 550", arg, strings.TrimSpace(out.String()))
+		}
+	}
+
+	for _, arg := range []string{"../escape-dir/new.txt", "/escape-dir/new.txt", "up/escape-dir/new.txt"} {
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		if tr := handleStorCommand(w, arg, user, fsys, "/sub", newPassiveChannel(t), "I", false, 0); tr != nil {
+			tr.abort()
+			t.Errorf("STOR %q started a transfer: %s", arg, <-tr.done)
+		}
+		if !strings.HasPrefix(out.String(), "550") {
+			t.Errorf("STOR %q: reply %q, want 550", arg, strings.TrimSpace(out.String()))
+		}
+	}
+
+	// A link inside the root still works
+	data := newPassiveChannel(t)
+	addr := data.listener.Addr().String()
+	var out bytes.Buffer
+	tr := handleRetrCommand(bufio.NewWriter(&out), "up/inner-link", fsys, "/sub", data, "I", 0)
+	if tr == nil {
+		t.Fatalf("RETR up/inner-link: reply %q", strings.TrimSpace(out.String()))
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(conn)
+	conn.Close()
+	if reply := <-tr.done; !strings.HasPrefix(reply, "226") || string(got) != "inside" {
+		t.Errorf("RETR up/inner-link: %q and %q, want 226 and %q", reply, got, "inside")
+	}
+}
+
+// closeTracker records whether the filesystem it wraps was closed.
+type closeTracker struct {
+	FileSystem
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReadOnly(t *testing.T) {
+	m := NewMemFileSystem()
+	m.WriteFile("/dir/f.txt", []byte("data"))
+	tracker := &closeTracker{FileSystem: m}
+	ro := ReadOnly(tracker)
+
+	if got := readMemFile(t, ro, "/dir/f.txt"); got != "data" {
+		t.Errorf("read %q", got)
+	}
+	if f, err := ro.OpenFile("/dir/f.txt", os.O_RDONLY, 0); err != nil {
+		t.Errorf("OpenFile(O_RDONLY): %v", err)
+	} else {
+		f.Close()
+	}
+	if _, err := ro.Stat("/dir"); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+	if got := dirNames(t, ro, "/dir"); len(got) != 1 {
+		t.Errorf("ReadDir = %v", got)
+	}
+
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_RDONLY | os.O_CREATE, os.O_RDONLY | os.O_TRUNC, os.O_WRONLY | os.O_APPEND} {
+		if _, err := ro.OpenFile("/dir/f.txt", flag, 0644); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("OpenFile with flag %#x: %v", flag, err)
+		}
+	}
+	for name, err := range map[string]error{
+		"Mkdir":   ro.Mkdir("/new", 0755),
+		"Remove":  ro.Remove("/dir/f.txt"),
+		"Rename":  ro.Rename("/dir/f.txt", "/g.txt"),
+		"Chtimes": ro.Chtimes("/dir/f.txt", time.Time{}, time.Unix(0, 0)),
+	} {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// Nothing changed underneath
+	if got := dirNames(t, m, "/"); len(got) != 1 {
+		t.Errorf("root holds %v", got)
+	}
+	if info, _ := m.Stat("/dir/f.txt"); info.ModTime().Equal(time.Unix(0, 0)) {
+		t.Error("modification time was changed")
+	}
+
+	closeFileSystem(ro)
+	if !tracker.closed {
+		t.Error("closing the read-only view did not close the wrapped filesystem")
+	}
+}
@@ -3,186 +3,980 @@ package server
 import (
 	"bufio"
 	"fmt"
+	"ftp/common"
+	"io"
 	"net"
 	"os"
-	"path/filepath"
+	"path"
+	"strconv"
 	"strings"
-	"io"
+	"time"
 )
 
-func handleHelpCommand(writer *bufio.Writer) {
+// handleHelpCommand lists the commands in the command table, or describes
+// the one named by arg.
+func handleHelpCommand(writer *bufio.Writer, arg string) {
+	if arg != "" {
+		c, ok := commands[strings.ToUpper(arg)]
+		if !ok {
+			sendLine(writer, "501 Unknown command "+arg)
+			return
+		}
+		sendLine(writer, fmt.Sprintf("214 Syntax: %s - %s", commandSyntax(c), c.help))
+		return
+	}
+
 	sendLine(writer, "214-Commands:")
-	cmds := []string{
-		"USER username",
-		"PASS password",
-		"PASV upgrade_connection",
-		"PWD current-dir",
-		"LIST list",
-		"CWD change_working_directory",
-		"CDUP move_cd_to_parent_dir",
-		"RETR file_name_to_retrieve",
-		"STOR upload_file",
-		"QUIT quit",
-	}
-	for _, c := range cmds {
-		sendLine(writer, "214-"+c)
+	for _, name := range commandNames {
+		c := commands[name]
+		sendLine(writer, fmt.Sprintf("214-%-28s %s", commandSyntax(c), c.help))
 	}
 	sendLine(writer, "214 End of HELP")
 }
 
-func handleUserCommand(writer *bufio.Writer, arg string) {
+func commandSyntax(c *command) string {
+	if c.usage == "" {
+		return c.name
+	}
+	return c.name + " " + c.usage
+}
 
+func handleUserCommand(writer *bufio.Writer, arg string, cfg Config, username *string) {
+	*username = arg
+	if cfg.AnonDir != "" && isAnonymousName(arg) {
+		sendLine(writer, "331 Guest login ok, send your email address as password")
+		return
+	}
 	sendLine(writer, fmt.Sprintf("331 User %s ok, need password", arg))
 }
 
-func handleCwdCommand(writer *bufio.Writer, arg string, rootDir string, currentDir *string) {
-	if arg == "" {
-		sendLine(writer, "501 Missing directory")
-		return
+// handlePassCommand verifies the password for the pending USER and returns the
+// logged in user, or nil if the login failed. On success fsys is set to the
+// tree served to the user.
+func handlePassCommand(writer *bufio.Writer, arg string, cfg Config, username *string, fsys *FileSystem, remote net.Addr) *User {
+	if *username == "" {
+		sendLine(writer, "503 Login with USER first")
+		return nil
+	}
+	name := *username
+	*username = ""
+
+	var user *User
+	switch {
+	case cfg.AnonDir != "" && isAnonymousName(name):
+		if !isEmailPassword(arg) {
+			sendLine(writer, "530 Send your email address as password")
+			return nil
+		}
+		logf(cfg.Logger, "Anonymous login (%s) from %s", arg, remote)
+		user = anonymousUser(cfg)
+	case cfg.Auth != nil:
+		var err error
+		user, err = cfg.Auth.Authenticate(name, arg)
+		if err != nil {
+			logf(cfg.Logger, "Failed login for %q from %s: %v", name, remote, err)
+			sendLine(writer, "530 Login incorrect")
+			return nil
+		}
+	default:
+		sendLine(writer, "530 Login incorrect")
+		return nil
 	}
 
-	// Normalize rootDir to absolute ONCE here:
-	absRoot, err := filepath.Abs(rootDir)
+	userFS, err := userFileSystem(cfg, user)
 	if err != nil {
-		sendLine(writer, "550 Server path error")
+		logf(cfg.Logger, "Home directory for %q unavailable: %v", user.Name, err)
+		sendLine(writer, "530 Home directory unavailable")
+		return nil
+	}
+
+	closeFileSystem(*fsys)
+	*fsys = userFS
+	logf(cfg.Logger, "User %q logged in from %s", user.Name, remote)
+	sendLine(writer, "230 User logged in")
+	return user
+}
+
+func handleCwdCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir *string) {
+	newDir := resolvePath(*currentDir, arg)
+
+	info, err := fsys.Stat(newDir)
+	if err != nil || !info.IsDir() {
+		sendLine(writer, "550 Not a directory")
 		return
 	}
 
-	// Build & normalize target path
-	newPath, err := filepath.Abs(filepath.Join(*currentDir, arg))
+	*currentDir = newDir
+	sendLine(writer, "250 Directory successfully changed")
+}
+
+func handleCdupCommand(writer *bufio.Writer, currentDir *string) {
+	// The virtual root is its own parent, so CDUP can never leave it
+	*currentDir = path.Dir(*currentDir)
+	sendLine(writer, "200 Command okay")
+}
+
+func handleDeleCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string) {
+	filePath := resolvePath(currentDir, arg)
+	info, err := fsys.Stat(filePath)
 	if err != nil {
-		sendLine(writer, "550 Invalid path")
+		sendLine(writer, "550 File not found")
+		return
+	}
+	if info.IsDir() {
+		sendLine(writer, "550 Is a directory, use RMD")
+		return
+	}
+	if err := fsys.Remove(filePath); err != nil {
+		sendLine(writer, "550 Delete failed")
 		return
 	}
+	sendLine(writer, "250 File deleted")
+}
 
-	// Prevent leaving root
-	if !strings.HasPrefix(newPath, absRoot) {
-		sendLine(writer, "550 Access denied")
+func handleMkdCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string) {
+	virtualPath := resolvePath(currentDir, arg)
+	if err := fsys.Mkdir(virtualPath, 0755); err != nil {
+		if os.IsExist(err) {
+			sendLine(writer, "550 Already exists")
+		} else {
+			sendLine(writer, "550 Create directory failed")
+		}
 		return
 	}
+	sendLine(writer, fmt.Sprintf("257 %s created", quotePath(virtualPath)))
+}
 
-	info, err := os.Stat(newPath)
+func handleRmdCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string) {
+	virtualPath := resolvePath(currentDir, arg)
+	if virtualPath == "/" {
+		sendLine(writer, "550 Cannot remove root directory")
+		return
+	}
+	info, err := fsys.Stat(virtualPath)
 	if err != nil || !info.IsDir() {
 		sendLine(writer, "550 Not a directory")
 		return
 	}
+	if err := fsys.Remove(virtualPath); err != nil {
+		sendLine(writer, "550 Remove directory failed; is it empty?")
+		return
+	}
+	sendLine(writer, "250 Directory removed")
+}
 
-	*currentDir = newPath
-	sendLine(writer, "250 Directory successfully changed")
+// handleRnfrCommand remembers the file to rename; the next command must be
+// RNTO.
+func handleRnfrCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string, renameFrom *string) {
+	virtualPath := resolvePath(currentDir, arg)
+	if virtualPath == "/" {
+		sendLine(writer, "550 Cannot rename root directory")
+		return
+	}
+	if _, err := fsys.Stat(virtualPath); err != nil {
+		sendLine(writer, "550 File not found")
+		return
+	}
+	*renameFrom = virtualPath
+	sendLine(writer, "350 Ready for RNTO")
 }
 
-func handleCdupCommand(writer *bufio.Writer, rootDir string, currentDir *string) {
-	absRoot, err := filepath.Abs(rootDir)
-	if err != nil {
-		sendLine(writer, "550 Server path error")
+func handleRntoCommand(writer *bufio.Writer, arg string, user *User, fsys FileSystem, currentDir string, renameFrom string) {
+	if renameFrom == "" {
+		sendLine(writer, "503 Use RNFR first")
+		return
+	}
+	fromPath := resolvePath("/", renameFrom)
+	virtualPath := resolvePath(currentDir, arg)
+	if virtualPath == "/" {
+		sendLine(writer, "550 Cannot rename onto root directory")
 		return
 	}
+	// Replacing an existing file needs the overwrite permission
+	if _, err := fsys.Stat(virtualPath); err == nil && !user.PermsAt(virtualPath).Has(PermOverwrite) {
+		sendLine(writer, "550 File exists; overwrite not permitted")
+		return
+	}
+	if err := fsys.Rename(fromPath, virtualPath); err != nil {
+		sendLine(writer, "550 Rename failed")
+		return
+	}
+	sendLine(writer, "250 Rename successful")
+}
 
-	// Compute parent
-	parent := filepath.Dir(*currentDir)
+// handleListCommand sends a listing of the directory or file arg, or of the
+// working directory, in the configured format. Like all listings it is text
+// with CRLF line endings whatever the TYPE.
+func handleListCommand(writer *bufio.Writer, arg string, format string, fsys FileSystem, currentDir string, data *dataChannel) *transfer {
+	if !data.ready() {
+		sendLine(writer, "425 Use PORT or PASV first")
+		return nil
+	}
 
-	parent, err = filepath.Abs(parent)
+	virtualPath := resolvePath(currentDir, listOptions(arg))
+	infos, err := readListing(fsys, virtualPath)
 	if err != nil {
-		sendLine(writer, "550 Invalid path")
-		return
+		sendLine(writer, "550 Failed to list directory")
+		return nil
 	}
 
-	// Prevent escape above root
-	if !strings.HasPrefix(parent, absRoot) {
-		sendLine(writer, "550 Access denied")
-		return
+	sendLine(writer, "150 Here comes the directory listing")
+
+	return sendData(data, "LIST "+virtualPath, "226 Directory send OK", nil, func(w io.Writer) error {
+		now := time.Now()
+		for _, info := range infos {
+			if _, err := fmt.Fprintf(w, "%s\r\n", formatListLine(info, format, now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// handleNlstCommand sends only the names of the entries in the directory arg,
+// or the working directory.
+func handleNlstCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string, data *dataChannel) *transfer {
+	if !data.ready() {
+		sendLine(writer, "425 Use PORT or PASV first")
+		return nil
 	}
 
-	*currentDir = parent
-	sendLine(writer, "200 Command okay")
+	virtualPath := resolvePath(currentDir, listOptions(arg))
+	infos, err := readListing(fsys, virtualPath)
+	if err != nil {
+		sendLine(writer, "550 Failed to list directory")
+		return nil
+	}
+
+	sendLine(writer, "150 Here comes the directory listing")
+
+	return sendData(data, "NLST "+virtualPath, "226 Directory send OK", nil, func(w io.Writer) error {
+		for _, info := range infos {
+			if _, err := fmt.Fprintf(w, "%s\r\n", info.Name()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func handleListCommand(writer *bufio.Writer, currentDir string, dataListener *net.Listener) {
-	if *dataListener == nil {
-		sendLine(writer, "425 Use PASV first")
-		return
+// handleMlsdCommand sends a machine-readable listing (RFC 3659) of the
+// directory arg, or the working directory, over the data connection.
+func handleMlsdCommand(writer *bufio.Writer, arg string, user *User, fsys FileSystem, currentDir string, data *dataChannel, facts []string) *transfer {
+	if !data.ready() {
+		sendLine(writer, "425 Use PORT or PASV first")
+		return nil
+	}
+
+	virtualPath := resolvePath(currentDir, arg)
+	info, err := fsys.Stat(virtualPath)
+	if err != nil || !info.IsDir() {
+		sendLine(writer, "501 Not a directory")
+		return nil
+	}
+	entries, err := fsys.ReadDir(virtualPath)
+	if err != nil {
+		sendLine(writer, "550 Failed to list directory")
+		return nil
 	}
 
 	sendLine(writer, "150 Here comes the directory listing")
 
-	dataConn, err := (*dataListener).Accept()
+	return sendData(data, "MLSD "+virtualPath, "226 Directory send OK", nil, func(w io.Writer) error {
+		for _, e := range entries {
+			if isTempUpload(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			perms := user.PermsAt(path.Join(virtualPath, e.Name()))
+			if _, err := fmt.Fprintf(w, "%s %s\r\n", formatFacts(info, perms, facts), e.Name()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// handleMlstCommand describes a single file or directory (RFC 3659) on the
+// control connection.
+func handleMlstCommand(writer *bufio.Writer, arg string, user *User, fsys FileSystem, currentDir string, facts []string) {
+	virtualPath := resolvePath(currentDir, arg)
+	info, err := fsys.Stat(virtualPath)
 	if err != nil {
-		sendLine(writer, "425 Can't open data connection")
-		(*dataListener).Close()
-		dataListener = nil
+		sendLine(writer, "550 No such file or directory")
 		return
 	}
 
-	// Now send the directory listing over dataConn
-	files, err := os.ReadDir(currentDir)
+	sendLine(writer, "250-Listing "+virtualPath)
+	sendLine(writer, fmt.Sprintf(" %s %s", formatFacts(info, user.PermsAt(virtualPath), facts), virtualPath))
+	sendLine(writer, "250 End")
+}
+
+// handleFeatCommand lists the optional extensions we support (RFC 2389).
+func handleFeatCommand(writer *bufio.Writer, cfg Config, facts []string, hashAlg string) {
+	features := []string{
+		"EPRT",
+		"EPSV",
+		hashFeature(hashAlg),
+		"MDTM",
+		"MFMT",
+		mlstFeature(facts),
+		"RANG STREAM",
+		"REST STREAM",
+		"SIZE",
+		"TVFS",
+		"UTF8",
+		"XCRC",
+		"XMD5",
+		"XSHA1",
+		"XSHA256",
+	}
+	if cfg.ModeZLevel > 0 {
+		features = append(features, "MODE Z")
+	}
+	if cfg.TLSConfig != nil {
+		features = append(features, "AUTH TLS", "PBSZ", "PROT")
+	}
+
+	sendLine(writer, "211-Features:")
+	for _, f := range features {
+		sendLine(writer, " "+f)
+	}
+	sendLine(writer, "211 End")
+}
+
+// handleOptsCommand sets options for other commands (RFC 2389): the MLST
+// facts with "OPTS MLST fact;fact;...", "OPTS UTF8 ON", the compression
+// level with "OPTS MODE Z LEVEL n" and the algorithm with "OPTS HASH name".
+func handleOptsCommand(writer *bufio.Writer, arg string, cfg Config, facts *[]string, data *dataChannel, hashAlg *string) {
+	name, value, _ := strings.Cut(arg, " ")
+	switch strings.ToUpper(name) {
+	case "HASH":
+		value = strings.TrimSpace(value)
+		if value == "" {
+			sendLine(writer, "200 "+*hashAlg)
+			return
+		}
+		alg, ok := findHashAlgorithm(value)
+		if !ok {
+			sendLine(writer, "501 Unknown hash algorithm")
+			return
+		}
+		*hashAlg = alg.name
+		sendLine(writer, "200 "+alg.name)
+	case "MODE":
+		fields := strings.Fields(strings.ToUpper(value))
+		if cfg.ModeZLevel == 0 || len(fields) == 0 || fields[0] != "Z" {
+			sendLine(writer, "501 Option not understood")
+			return
+		}
+		if len(fields) != 3 || fields[1] != "LEVEL" {
+			sendLine(writer, "501 Only LEVEL is supported")
+			return
+		}
+		level, err := strconv.Atoi(fields[2])
+		if err != nil || level < 1 || level > 9 {
+			sendLine(writer, "501 LEVEL must be 1 to 9")
+			return
+		}
+		data.compressLevel = level
+		sendLine(writer, fmt.Sprintf("200 MODE Z LEVEL set to %d", level))
+	case "UTF8":
+		// Paths are always UTF-8 (RFC 2640), so this only acknowledges it
+		switch strings.ToUpper(strings.TrimSpace(value)) {
+		case "", "ON":
+			sendLine(writer, "200 UTF8 set to on")
+		default:
+			sendLine(writer, "504 UTF8 cannot be turned off")
+		}
+	case "MLST":
+		*facts = parseMlstFacts(value)
+		reply := "200 MLST OPTS"
+		if len(*facts) > 0 {
+			reply += " " + strings.Join(*facts, ";") + ";"
+		}
+		sendLine(writer, reply)
+	default:
+		sendLine(writer, "501 Option not understood")
+	}
+}
+
+// handleTypeCommand sets the representation type (RFC 959). ASCII and image
+// (binary) are supported, the latter also as "L 8".
+func handleTypeCommand(writer *bufio.Writer, arg string, transferType *string) {
+	fields := strings.Fields(strings.ToUpper(arg))
+	switch {
+	case len(fields) == 1 && fields[0] == "A", len(fields) == 2 && fields[0] == "A" && fields[1] == "N":
+		*transferType = "A"
+		sendLine(writer, "200 Type set to A")
+	case len(fields) == 1 && fields[0] == "I", len(fields) == 2 && fields[0] == "L" && fields[1] == "8":
+		*transferType = "I"
+		sendLine(writer, "200 Type set to I")
+	default:
+		sendLine(writer, "504 Type not supported")
+	}
+}
+
+// handleModeCommand sets the transfer mode: stream (S), or deflate compressed
+// stream (Z) if enabled.
+func handleModeCommand(writer *bufio.Writer, arg string, cfg Config, data *dataChannel) {
+	switch strings.ToUpper(arg) {
+	case "S":
+		data.compress = false
+		sendLine(writer, "200 Mode set to S")
+	case "Z":
+		if cfg.ModeZLevel == 0 {
+			sendLine(writer, "504 Mode not supported")
+			return
+		}
+		data.compress = true
+		sendLine(writer, "200 Mode set to Z")
+	default:
+		sendLine(writer, "504 Mode not supported")
+	}
+}
+
+// handleStruCommand sets the file structure. Only file structure is
+// supported.
+func handleStruCommand(writer *bufio.Writer, arg string) {
+	switch strings.ToUpper(arg) {
+	case "F":
+		sendLine(writer, "200 Structure set to F")
+	default:
+		sendLine(writer, "504 Structure not supported")
+	}
+}
+
+// handleRetrCommand sends a file. In ASCII mode (TYPE A) line endings are
+// converted to CRLF on the way.
+func handleRetrCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string, data *dataChannel, transferType string, offset int64) *transfer {
+	if !data.ready() {
+		sendLine(writer, "425 Use PORT or PASV first")
+		return nil
+	}
+	if offset > 0 && transferType == "A" {
+		sendLine(writer, "554 Restart not supported in ASCII mode, use TYPE I")
+		return nil
+	}
+
+	virtualPath := resolvePath(currentDir, arg)
+	f, err := fsys.Open(virtualPath)
 	if err != nil {
-		sendLine(writer, "550 Failed to list directory")
-		dataConn.Close()
-		(*dataListener).Close()
-		*dataListener = nil
+		sendLine(writer, "550 File not found")
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		sendLine(writer, "550 File not found")
+		return nil
+	}
+	if info.IsDir() {
+		f.Close()
+		sendLine(writer, "550 Is a directory")
+		return nil
+	}
+
+	if offset > 0 {
+		// Seeking past the end would succeed and send nothing
+		if offset > info.Size() {
+			err = io.ErrUnexpectedEOF
+		} else {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			sendLine(writer, "554 Invalid restart offset")
+			return nil
+		}
+	}
+
+	sendLine(writer, "150 Opening data connection for file transfer")
+
+	return sendData(data, "RETR "+virtualPath, "226 Transfer complete", f, func(w io.Writer) error {
+		var src io.Reader = f
+		if transferType == "A" {
+			src = common.ToCRLF(f)
+		}
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// handleStorCommand receives an upload. A new upload is written to a hidden
+// temporary file that replaces the destination only once complete. With
+// appendMode (APPE) data is added to the end of the file; otherwise a
+// non-zero offset from REST resumes an upload, keeping the first offset bytes
+// of the existing file. Both of these write in place.
+func handleStorCommand(writer *bufio.Writer, arg string, user *User, fsys FileSystem, currentDir string, data *dataChannel, transferType string, appendMode bool, offset int64) *transfer {
+	if !data.ready() {
+		sendLine(writer, "425 Use PORT or PASV first")
+		return nil
+	}
+
+	// Path for uploaded file
+	virtualPath := resolvePath(currentDir, arg)
+
+	// Changing an existing file needs the overwrite permission
+	info, statErr := fsys.Stat(virtualPath)
+	if statErr == nil && info.IsDir() {
+		sendLine(writer, "550 Is a directory")
+		return nil
+	}
+	if statErr == nil && !user.PermsAt(virtualPath).Has(PermOverwrite) {
+		sendLine(writer, "550 File exists; overwrite not permitted")
+		return nil
+	}
+	if offset > 0 && transferType == "A" {
+		sendLine(writer, "554 Restart not supported in ASCII mode, use TYPE I")
+		return nil
+	}
+	if offset > 0 && (statErr != nil || offset > info.Size()) {
+		sendLine(writer, "554 Invalid restart offset")
+		return nil
+	}
+
+	var up upload
+	var f File
+	var err error
+	switch {
+	case appendMode:
+		f, err = fsys.OpenFile(virtualPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		up = inPlaceUpload{f}
+	case offset > 0:
+		f, err = fsys.OpenFile(virtualPath, os.O_WRONLY, 0644)
+		if err == nil {
+			// Drop whatever followed the restart point, then carry on
+			// writing from there
+			err = f.Truncate(offset)
+		}
+		if err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		up = inPlaceUpload{f}
+	default:
+		// Without the overwrite permission the upload must not replace a
+		// file that appeared since the check above, e.g. another upload
+		// to the same name
+		noReplace := !user.PermsAt(virtualPath).Has(PermOverwrite)
+		up, err = createTempUpload(fsys, virtualPath, noReplace)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		sendLine(writer, "550 Cannot create file")
+		return nil
+	}
+
+	sendLine(writer, "150 Opening data connection for file upload")
+
+	desc := "STOR " + virtualPath
+	if appendMode {
+		desc = "APPE " + virtualPath
+	}
+	return receiveUpload(data, desc, "226 Transfer complete", up, transferType)
+}
+
+// handleStouCommand receives an upload under a name that is not taken yet
+// (RFC 1123): arg if given and free, or arg or "upload" with a number added.
+func handleStouCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string, data *dataChannel, transferType string) *transfer {
+	if !data.ready() {
+		sendLine(writer, "425 Use PORT or PASV first")
+		return nil
+	}
+
+	dir, base := currentDir, "upload"
+	if arg != "" {
+		requested := resolvePath(currentDir, arg)
+		if requested != "/" {
+			dir, base = path.Split(requested)
+		}
+	}
+	virtualPath, ok := uniqueName(fsys, dir, base)
+	if !ok {
+		sendLine(writer, "553 Could not find a unique file name")
+		return nil
+	}
+
+	up, err := createTempUpload(fsys, virtualPath, true)
+	if err != nil {
+		sendLine(writer, "550 Cannot create file")
+		return nil
+	}
+
+	name := path.Base(virtualPath)
+	sendLine(writer, "150 FILE: "+name)
+	return receiveUpload(data, "STOU "+virtualPath, "226 Transfer complete (unique file name: "+name+")", up, transferType)
+}
+
+// receiveUpload copies the data of an upload into up, converting CRLF line
+// endings to the local convention in ASCII mode, and commits it once all has
+// arrived.
+func receiveUpload(data *dataChannel, desc string, okReply string, up upload, transferType string) *transfer {
+	return receiveData(data, desc, okReply, up, func(r io.Reader) error {
+		src := r
+		if transferType == "A" {
+			src = common.FromCRLF(r)
+		}
+		if _, err := io.Copy(up, src); err != nil {
+			return err
+		}
+		return up.commit()
+	})
+}
+
+// handleAborCommand aborts the running transfer, if any (RFC 959). The
+// transfer's own reply, usually 426, comes before the reply to ABOR.
+func handleAborCommand(writer *bufio.Writer, current *transfer, data *dataChannel) {
+	data.reset()
+	if current == nil {
+		sendLine(writer, "225 No transfer to abort")
 		return
 	}
+	current.abort()
+	sendLine(writer, <-current.done)
+	sendLine(writer, "226 Abort successful")
+}
 
-	for _, f := range files {
-		info, err := f.Info()
+// handleStatCommand reports the progress of the running transfer or the state
+// of the session. With an argument it lists that path over the control
+// connection instead.
+func handleStatCommand(writer *bufio.Writer, arg string, user *User, fsys FileSystem, currentDir string, current *transfer, transferType string, tlsActive bool, dataProtected bool) {
+	if arg != "" {
+		virtualPath := resolvePath(currentDir, listOptions(arg))
+		if !user.PermsAt(virtualPath).Has(PermList) {
+			sendLine(writer, permDeniedReply(PermList))
+			return
+		}
+		infos, err := readListing(fsys, virtualPath)
 		if err != nil {
-			continue
+			sendLine(writer, "550 No such file or directory")
+			return
+		}
+		sendLine(writer, "213-Status of "+virtualPath+":")
+		now := time.Now()
+		for _, info := range infos {
+			sendLine(writer, " "+formatListLine(info, ListUnix, now))
 		}
-		itemType := "File"
-        if info.IsDir() {
-            itemType = "Folder"
-        }
-		sizeStr := humanReadableSize(info.Size())
+		sendLine(writer, "213 End of status")
+		return
+	}
 
+	if current != nil {
+		elapsed := time.Since(current.started).Round(time.Second)
+		sendLine(writer, fmt.Sprintf("213 Status: %s, %d bytes transferred in %s", current.desc, current.bytes.Load(), elapsed))
+		return
+	}
 
-		modTime := info.ModTime().Format("Jan _2 15:04")
-		line := fmt.Sprintf("%-6s %-10s %-20s %s\r\n", itemType, sizeStr, modTime, f.Name())
-        dataConn.Write([]byte(line))
+	typeName := "ASCII"
+	if transferType == "I" {
+		typeName = "BINARY"
+	}
+	control, dataConns := "plain", "clear"
+	if tlsActive {
+		control = "TLS"
+	}
+	if dataProtected {
+		dataConns = "protected"
+	}
+	sendLine(writer, "211-FTP server status:")
+	sendLine(writer, " Logged in as "+user.Name)
+	sendLine(writer, " TYPE: "+typeName)
+	sendLine(writer, " Control connection: "+control)
+	sendLine(writer, " Data connections: "+dataConns)
+	sendLine(writer, " No data transfer in progress")
+	sendLine(writer, "211 End of status")
+}
 
-		// line := fmt.Sprintf("%s %12d %s %s\r\n", fileModeToStr(info.Mode()), info.Size(), modTime, f.Name())
-		// dataConn.Write([]byte(line))
+// handleRestCommand sets the restart offset for the next RETR or STOR.
+func handleRestCommand(writer *bufio.Writer, arg string, restOffset *int64) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		sendLine(writer, "501 Invalid restart offset")
+		return
 	}
+	*restOffset = offset
+	sendLine(writer, fmt.Sprintf("350 Restarting at %d. Send STOR or RETR", offset))
+}
 
-	dataConn.Close()
-	(*dataListener).Close()
-	*dataListener = nil
+// handleSizeCommand answers SIZE (RFC 3659) with the size of a file in bytes.
+func handleSizeCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string) {
+	info, ok := statFileArg(writer, arg, fsys, currentDir)
+	if !ok {
+		return
+	}
+	sendLine(writer, fmt.Sprintf("213 %d", info.Size()))
+}
 
-	sendLine(writer, "226 Directory send OK")
+// handleMdtmCommand answers MDTM (RFC 3659) with a file's modification time.
+func handleMdtmCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string) {
+	info, ok := statFileArg(writer, arg, fsys, currentDir)
+	if !ok {
+		return
+	}
+	sendLine(writer, "213 "+formatFTPTime(info.ModTime()))
+}
+
+// handleMfmtCommand sets a file's modification time. The argument is
+// "YYYYMMDDHHMMSS path", in UTC.
+func handleMfmtCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string) {
+	timeArg, name, _ := strings.Cut(arg, " ")
+	mtime, err := parseFTPTime(timeArg)
+	if err != nil {
+		sendLine(writer, "501 Invalid time, use YYYYMMDDHHMMSS")
+		return
+	}
+	info, ok := statFileArg(writer, strings.TrimSpace(name), fsys, currentDir)
+	if !ok {
+		return
+	}
+
+	filePath := resolvePath(currentDir, strings.TrimSpace(name))
+	if err := fsys.Chtimes(filePath, time.Time{}, mtime); err != nil {
+		sendLine(writer, "550 Could not set modification time")
+		return
+	}
+	sendLine(writer, fmt.Sprintf("213 Modify=%s; %s", formatFTPTime(mtime), info.Name()))
 }
 
+// handleHashCommand answers HASH (draft-bryan-ftpext-hash) with the hash of
+// a file, or of the range set by RANG.
+func handleHashCommand(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string, hashAlg string, rng *byteRange) {
+	alg, _ := findHashAlgorithm(hashAlg)
+	filePath := resolvePath(currentDir, arg)
+	sum, hashed, err := hashFile(fsys, filePath, alg, rng)
+	if !sendHashError(writer, err) {
+		return
+	}
+	sendLine(writer, fmt.Sprintf("213 %s %d-%d %s %s", alg.name, hashed.first, hashed.last, sum, arg))
+}
 
-func handleRetrCommand(writer *bufio.Writer, arg string, currentDir string, dataListener *net.Listener) {
+// handleRangCommand sets the byte range, first to last inclusive, for the
+// next HASH. "RANG 1 0" clears it.
+func handleRangCommand(writer *bufio.Writer, arg string, rng **byteRange) {
+	firstArg, lastArg, _ := strings.Cut(arg, " ")
+	first, err1 := strconv.ParseInt(firstArg, 10, 64)
+	last, err2 := strconv.ParseInt(strings.TrimSpace(lastArg), 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < 0 {
+		sendLine(writer, "501 Syntax error in parameters or arguments")
+		return
+	}
+	if first > last {
+		*rng = nil
+		sendLine(writer, "350 Restarting at 0. Ending byte at EOF.")
+		return
+	}
+	*rng = &byteRange{first, last}
+	sendLine(writer, fmt.Sprintf("350 Restarting at %d. Ending byte at %d.", first, last))
+}
+
+// handleXHashCommand answers XCRC, XMD5, XSHA1 and XSHA256 with the checksum
+// of a file, optionally of the bytes from first to last inclusive.
+func handleXHashCommand(writer *bufio.Writer, cmd string, arg string, fsys FileSystem, currentDir string) {
+	name, rng := parseXHashArg(arg)
+	if name == "" {
+		sendLine(writer, "501 Syntax error in parameters or arguments")
+		return
+	}
+	alg, _ := findHashAlgorithm(xHashCommands[cmd])
+	filePath := resolvePath(currentDir, name)
+	sum, _, err := hashFile(fsys, filePath, alg, rng)
+	if !sendHashError(writer, err) {
+		return
+	}
+	sendLine(writer, "250 "+sum)
+}
+
+// sendHashError replies to a failed hash and reports whether err was nil.
+func sendHashError(writer *bufio.Writer, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case err == errInvalidRange:
+		sendLine(writer, "554 Invalid range")
+	case err == errNotRegular || os.IsNotExist(err):
+		sendLine(writer, "550 No such file")
+	default:
+		sendLine(writer, "451 Could not hash file")
+	}
+	return false
+}
+
+// statFileArg stats the regular file named by arg, replying with an error and
+// returning false if there is none.
+func statFileArg(writer *bufio.Writer, arg string, fsys FileSystem, currentDir string) (os.FileInfo, bool) {
 	if arg == "" {
 		sendLine(writer, "501 Syntax error in parameters or arguments")
+		return nil, false
+	}
+
+	filePath := resolvePath(currentDir, arg)
+	info, err := fsys.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		sendLine(writer, "550 No such file")
+		return nil, false
+	}
+	return info, true
+}
+
+func handlePasvCommand(writer *bufio.Writer, cfg Config, data *dataChannel, local net.Addr) {
+	// PASV can only describe IPv4 addresses
+	ip, err := passiveIP(cfg.PassiveAddr, local)
+	if err != nil {
+		logf(cfg.Logger, "Passive address lookup failed: %v", err)
+		sendLine(writer, "425 Can't open data connection")
 		return
 	}
-	if (*dataListener) == nil {
-		sendLine(writer, "425 Use PASV first")
+	if ip == nil {
+		sendLine(writer, "425 PASV needs an IPv4 connection, use EPSV")
 		return
 	}
 
-	filepath := filepath.Join(currentDir, arg)
-	f, err := os.Open(filepath)
+	// Listen on any available port in the configured range
+	ln, err := listenPassive("tcp4", "0.0.0.0", cfg.PassivePorts)
 	if err != nil {
-		sendLine(writer, "550 File not found")
+		logf(cfg.Logger, "Passive listen failed: %v", err)
+		sendLine(writer, "425 Can't open data connection")
 		return
 	}
-	defer f.Close()
+	data.setPassive(ln)
 
-	sendLine(writer, "150 Opening data connection for file transfer")
+	// Get the port
+	addr := ln.Addr().(*net.TCPAddr)
+	p1 := addr.Port / 256
+	p2 := addr.Port % 256
+
+	// Send PASV response with server IP and port
+	sendLine(writer, fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], p1, p2))
+}
+
+// handleEpsvCommand implements EPSV (RFC 2428). The data listener is opened on
+// the address the client reached us on, so it works for IPv4 and IPv6 alike.
+// "EPSV ALL" tells us the client will not use any other data command.
+func handleEpsvCommand(writer *bufio.Writer, arg string, cfg Config, data *dataChannel, local net.Addr, epsvAll *bool) {
+	ip := connIP(local)
+	switch strings.ToUpper(arg) {
+	case "":
+	case "ALL":
+		*epsvAll = true
+		sendLine(writer, "200 EPSV ALL ok")
+		return
+	case "1":
+		if ip.To4() == nil {
+			sendLine(writer, "522 Network protocol not supported, use (2)")
+			return
+		}
+	case "2":
+		if ip.To4() != nil {
+			sendLine(writer, "522 Network protocol not supported, use (1)")
+			return
+		}
+	default:
+		sendLine(writer, "522 Network protocol not supported, use (1,2)")
+		return
+	}
 
-	dataConn, err := (*dataListener).Accept()
+	ln, err := listenPassive("tcp", connHost(local), cfg.PassivePorts)
 	if err != nil {
+		logf(cfg.Logger, "Passive listen failed: %v", err)
 		sendLine(writer, "425 Can't open data connection")
-		(*dataListener).Close()
-		(*dataListener) = nil
 		return
 	}
+	data.setPassive(ln)
 
-	io.Copy(dataConn, f)
-	dataConn.Close()
-	(*dataListener).Close()
-	(*dataListener) = nil
+	port := ln.Addr().(*net.TCPAddr).Port
+	sendLine(writer, fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", port))
+}
+
+func handlePortCommand(writer *bufio.Writer, arg string, data *dataChannel, remote net.Addr) {
+	addr, err := parsePortArg(arg)
+	if err != nil {
+		sendLine(writer, "501 Syntax error in parameters or arguments")
+		return
+	}
+	if err := checkActiveAddr(addr, remote); err != nil {
+		logf(data.logger, "Rejected PORT from %s: %v", remote, err)
+		sendLine(writer, "504 Command not implemented for that parameter")
+		return
+	}
+	data.setActive(addr)
+	sendLine(writer, "200 PORT command successful")
+}
 
-	sendLine(writer, "226 Transfer complete")
-}
\ No newline at end of file
+func handleEprtCommand(writer *bufio.Writer, arg string, data *dataChannel, remote net.Addr) {
+	addr, err := parseEprtArg(arg)
+	if err == errUnsupportedProto {
+		sendLine(writer, "522 Network protocol not supported, use (1,2)")
+		return
+	}
+	if err != nil {
+		sendLine(writer, "501 Syntax error in parameters or arguments")
+		return
+	}
+	if err := checkActiveAddr(addr, remote); err != nil {
+		logf(data.logger, "Rejected EPRT from %s: %v", remote, err)
+		sendLine(writer, "504 Command not implemented for that parameter")
+		return
+	}
+	data.setActive(addr)
+	sendLine(writer, "200 EPRT command successful")
+}
+
+// handleAuthCommand answers AUTH (RFC 4217) and reports whether the caller
+// should now upgrade the control connection to TLS.
+func handleAuthCommand(writer *bufio.Writer, arg string, cfg Config, tlsActive bool) bool {
+	if cfg.TLSConfig == nil {
+		sendLine(writer, "502 TLS not configured")
+		return false
+	}
+	if tlsActive {
+		sendLine(writer, "503 Already using TLS")
+		return false
+	}
+	switch strings.ToUpper(arg) {
+	case "TLS", "TLS-C", "SSL":
+		sendLine(writer, "234 AUTH TLS successful")
+		return true
+	}
+	sendLine(writer, "504 Unknown security mechanism")
+	return false
+}
+
+func handlePbszCommand(writer *bufio.Writer, arg string, tlsActive bool, pbszSet *bool) {
+	if !tlsActive {
+		sendLine(writer, "503 PBSZ requires AUTH TLS first")
+		return
+	}
+	// TLS is a streaming protocol, so the only buffer size is 0
+	*pbszSet = true
+	sendLine(writer, "200 PBSZ=0")
+}
+
+// handleProtCommand sets the data connection protection level. mustProtect
+// refuses clear data connections, as required by RequireTLS and implicit FTPS.
+func handleProtCommand(writer *bufio.Writer, arg string, cfg Config, pbszSet bool, mustProtect bool, data *dataChannel) {
+	if !pbszSet {
+		sendLine(writer, "503 PROT requires PBSZ first")
+		return
+	}
+	switch strings.ToUpper(arg) {
+	case "P":
+		data.tlsConfig = cfg.TLSConfig
+		sendLine(writer, "200 Protection level set to P")
+	case "C":
+		if mustProtect {
+			sendLine(writer, "534 Data connections must be protected")
+			return
+		}
+		data.tlsConfig = nil
+		sendLine(writer, "200 Protection level set to C")
+	case "S", "E":
+		sendLine(writer, "536 Protection level not supported")
+	default:
+		sendLine(writer, "504 Unknown protection level")
+	}
+}
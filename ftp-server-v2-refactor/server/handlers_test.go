@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRetrRestartOffset(t *testing.T) {
+	fsys := NewMemFileSystem()
+	fsys.WriteFile("/f.bin", []byte("0123456789"))
+
+	tests := []struct {
+		offset int64
+		reply  string
+		data   string
+	}{
+		{4, "226", "456789"},
+		{10, "226", ""},
+		{11, "554", ""},
+		{1 << 40, "554", ""},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		data := newPassiveChannel(t)
+		addr := data.listener.Addr().String()
+		tr := handleRetrCommand(bufio.NewWriter(&out), "f.bin", fsys, "/", data, "I", tt.offset)
+		if tr == nil {
+			if !strings.HasPrefix(out.String(), tt.reply) {
+				t.Errorf("REST %d: reply %q, want %s", tt.offset, strings.TrimSpace(out.String()), tt.reply)
+			}
+			continue
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if reply := <-tr.done; !strings.HasPrefix(reply, tt.reply) || string(got) != tt.data {
+			t.Errorf("REST %d: %q and %q, want %s and %q", tt.offset, reply, got, tt.reply, tt.data)
+		}
+	}
+}
+
+func TestRetrDirectory(t *testing.T) {
+	fsys := NewMemFileSystem()
+	fsys.WriteFile("/dir/f.txt", []byte("x"))
+
+	for _, arg := range []string{"dir", "/", "."} {
+		var out bytes.Buffer
+		if tr := handleRetrCommand(bufio.NewWriter(&out), arg, fsys, "/", newPassiveChannel(t), "I", 0); tr != nil {
+			tr.abort()
+			t.Errorf("RETR %q started a transfer: %s", arg, <-tr.done)
+		}
+		if got := strings.TrimSpace(out.String()); !strings.HasPrefix(got, "550") {
+			t.Errorf("RETR %q: reply %q, want 550", arg, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// hashAlgorithm is a hash offered by HASH and the X* checksum commands.
+type hashAlgorithm struct {
+	name string
+	new  func() hash.Hash
+}
+
+// hashAlgorithms are the algorithms HASH supports, in FEAT order. The first
+// one is the default.
+var hashAlgorithms = []hashAlgorithm{
+	{"SHA-256", sha256.New},
+	{"SHA-1", sha1.New},
+	{"MD5", md5.New},
+	{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// xHashCommands maps the non-standard checksum commands to their algorithm.
+var xHashCommands = map[string]string{
+	"XCRC":    "CRC32",
+	"XMD5":    "MD5",
+	"XSHA1":   "SHA-1",
+	"XSHA256": "SHA-256",
+}
+
+func findHashAlgorithm(name string) (hashAlgorithm, bool) {
+	for _, alg := range hashAlgorithms {
+		if strings.EqualFold(alg.name, name) {
+			return alg, true
+		}
+	}
+	return hashAlgorithm{}, false
+}
+
+// hashFeature returns the HASH line of the FEAT reply, marking the selected
+// algorithm with '*'.
+func hashFeature(selected string) string {
+	names := make([]string, len(hashAlgorithms))
+	for i, alg := range hashAlgorithms {
+		names[i] = alg.name
+		if alg.name == selected {
+			names[i] += "*"
+		}
+	}
+	return "HASH " + strings.Join(names, ";")
+}
+
+// byteRange selects the bytes from first to last, inclusive, of a file.
+type byteRange struct {
+	first, last int64
+}
+
+var (
+	errNotRegular   = errors.New("not a regular file")
+	errInvalidRange = errors.New("invalid range")
+)
+
+// hashFile hashes the bytes of a file selected by r, or the whole file if r
+// is nil. A range reaching past the end of the file is cut short. It returns
+// the hex encoded hash and the range actually hashed.
+func hashFile(fsys FileSystem, name string, alg hashAlgorithm, r *byteRange) (string, byteRange, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", byteRange{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", byteRange{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", byteRange{}, errNotRegular
+	}
+
+	rng := byteRange{0, info.Size() - 1}
+	if r != nil {
+		rng = *r
+		if rng.last >= info.Size() {
+			rng.last = info.Size() - 1
+		}
+		if rng.first > rng.last && !(rng.first == 0 && info.Size() == 0) {
+			return "", byteRange{}, errInvalidRange
+		}
+	}
+
+	h := alg.new()
+	if _, err := f.Seek(rng.first, io.SeekStart); err != nil {
+		return "", byteRange{}, err
+	}
+	if _, err := io.Copy(h, io.LimitReader(f, rng.last-rng.first+1)); err != nil {
+		return "", byteRange{}, err
+	}
+	// An empty file is reported as the range 0-0
+	if rng.last < rng.first {
+		rng.last = rng.first
+	}
+	return hex.EncodeToString(h.Sum(nil)), rng, nil
+}
+
+// parseXHashArg splits the argument of XCRC, XMD5, XSHA1 and XSHA256, which is
+// a path optionally followed by the first and last byte to hash. The path may
+// be quoted.
+func parseXHashArg(arg string) (string, *byteRange) {
+	name := strings.TrimSpace(arg)
+	var r *byteRange
+	if i := strings.LastIndexByte(name, ' '); i > 0 {
+		rest := strings.TrimSpace(name[:i])
+		if j := strings.LastIndexByte(rest, ' '); j > 0 {
+			first, err1 := strconv.ParseInt(rest[j+1:], 10, 64)
+			last, err2 := strconv.ParseInt(name[i+1:], 10, 64)
+			if err1 == nil && err2 == nil && first >= 0 && last >= first {
+				r = &byteRange{first, last}
+				name = strings.TrimSpace(rest[:j])
+			}
+		}
+	}
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		name = name[1 : len(name)-1]
+	}
+	return name, r
+}
@@ -1,21 +1,24 @@
 package server
 
-import(
+import (
 	"bufio"
+	"errors"
+	"fmt"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"fmt"
+	"time"
 )
 
-
 func sendLine(w *bufio.Writer, line string) {
 	// fmt.Fprintln(w, line)
 	w.WriteString(line + "\r\n")
 	w.Flush()
 }
 
-
 func parseCmd(line string) (string, string) {
 	parts := strings.SplitN(line, " ", 2)
 	cmd := parts[0]
@@ -26,24 +29,177 @@ func parseCmd(line string) (string, string) {
 	return cmd, arg
 }
 
-func getLANIP() string {
+// stripTelnet removes Telnet commands (IAC followed by a command byte), such
+// as the Interrupt Process some clients send before ABOR.
+func stripTelnet(line string) string {
+	if !strings.Contains(line, "\xff") {
+		return line
+	}
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] == 0xff {
+			i++
+			continue
+		}
+		b.WriteByte(line[i])
+	}
+	return b.String()
+}
+
+// resolvePath turns a client supplied path, absolute or relative to the
+// virtual working directory cwd, into the cleaned virtual path the session's
+// FileSystem takes. Cleaning the path as if it were rooted at "/" drops any
+// leading "..", so the result never leaves the root.
+func resolvePath(cwd, arg string) string {
+	virtual := arg
+	if !path.IsAbs(virtual) {
+		virtual = path.Join(cwd, virtual)
+	}
+	return path.Clean("/" + virtual)
+}
+
+// quotePath quotes a path for a 257 reply, doubling any embedded quotes as
+// RFC 959 requires.
+func quotePath(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+}
+
+// ftpTimeFormat is the YYYYMMDDHHMMSS time-val of RFC 3659, always in UTC.
+const ftpTimeFormat = "20060102150405"
+
+func formatFTPTime(t time.Time) string {
+	return t.UTC().Format(ftpTimeFormat)
+}
+
+// parseFTPTime parses a time-val, ignoring any fractional seconds.
+func parseFTPTime(s string) (time.Time, error) {
+	s, _, _ = strings.Cut(s, ".")
+	return time.ParseInLocation(ftpTimeFormat, s, time.UTC)
+}
+
+// userRoot returns the absolute host directory for a user's home. A relative
+// home is taken relative to sharedDir and must exist.
+func userRoot(sharedDir, home string) (string, error) {
+	root := home
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(sharedDir, root)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", root)
+	}
+	return root, nil
+}
+
+// parsePortArg parses the h1,h2,h3,h4,p1,p2 argument of PORT.
+func parsePortArg(arg string) (*net.TCPAddr, error) {
+	fields := strings.Split(arg, ",")
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected h1,h2,h3,h4,p1,p2")
+	}
+	var nums [6]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 || n > 255 {
+			return nil, fmt.Errorf("invalid number %q", f)
+		}
+		nums[i] = n
+	}
+	ip := net.IPv4(byte(nums[0]), byte(nums[1]), byte(nums[2]), byte(nums[3]))
+	return &net.TCPAddr{IP: ip, Port: nums[4]*256 + nums[5]}, nil
+}
+
+// parseEprtArg parses the <d>proto<d>addr<d>port<d> argument of EPRT
+// (RFC 2428), e.g. |1|132.235.1.2|6275| or |2|1080::8:800:200C:417A|5282|.
+func parseEprtArg(arg string) (*net.TCPAddr, error) {
+	if len(arg) < 1 {
+		return nil, fmt.Errorf("empty argument")
+	}
+	fields := strings.Split(arg, arg[:1])
+	if len(fields) != 5 || fields[0] != "" || fields[4] != "" {
+		return nil, fmt.Errorf("expected <d>proto<d>addr<d>port<d>")
+	}
+	if fields[1] != "1" && fields[1] != "2" {
+		return nil, errUnsupportedProto
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", fields[2])
+	}
+	if isV4 := ip.To4() != nil; isV4 != (fields[1] == "1") {
+		return nil, fmt.Errorf("address %s does not match protocol %s", ip, fields[1])
+	}
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", fields[3])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+var errUnsupportedProto = errors.New("unsupported network protocol")
+
+// checkActiveAddr guards against FTP bounce attacks (RFC 2577): the client may
+// only ask us to connect back to its own address, and never to a privileged
+// port.
+func checkActiveAddr(addr *net.TCPAddr, remote net.Addr) error {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return err
+	}
+	if !addr.IP.Equal(net.ParseIP(host)) {
+		return fmt.Errorf("address %s does not match control connection %s", addr.IP, host)
+	}
+	if addr.Port < 1024 {
+		return fmt.Errorf("port %d is privileged", addr.Port)
+	}
+	return nil
+}
+
+// getLANIP returns the first non-loopback IPv4 address of this host, used to
+// advertise passive data connections.
+func getLANIP() net.IP {
 	addrs, _ := net.InterfaceAddrs()
 	for _, addr := range addrs {
 		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-			return strings.ReplaceAll(ipnet.IP.String(), ".", ",")
+			return ipnet.IP.To4()
 		}
 	}
-	return "127,0,0,1" // fallback
+	return net.IPv4(127, 0, 0, 1).To4() // fallback
 }
 
+// connHost returns the IP address of addr, a TCP address, for listening on,
+// keeping the zone of an IPv6 link-local address.
+func connHost(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return (&net.IPAddr{IP: tcpAddr.IP, Zone: tcpAddr.Zone}).String()
+	}
+	return ""
+}
 
+// connIP returns the IP address of addr, which must be a TCP address.
+func connIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
 
 func fileModeToStr(mode os.FileMode) string {
 	// Simplified version of ls -l mode string
 	var str strings.Builder
-	if mode.IsDir() {
+	switch {
+	case mode.IsDir():
 		str.WriteByte('d')
-	} else {
+	case mode&os.ModeSymlink != 0:
+		str.WriteByte('l')
+	default:
 		str.WriteByte('-')
 	}
 	perms := []struct {
@@ -63,21 +219,3 @@ func fileModeToStr(mode os.FileMode) string {
 	}
 	return str.String()
 }
-
-func humanReadableSize(size int64) string {
-    const unit = 1024
-    if size < unit {
-        return fmt.Sprintf("%d B", size)
-    }
-    div, exp := int64(unit), 0
-    for n := size / unit; n >= unit; n /= unit {
-        div *= unit
-        exp++
-    }
-    value := float64(size) / float64(div)
-    units := []string{"KB", "MB", "GB", "TB"}
-    if exp >= len(units) {
-        exp = len(units) - 1
-    }
-    return fmt.Sprintf("%.2f %s", value, units[exp])
-}
\ No newline at end of file
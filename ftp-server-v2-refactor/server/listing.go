@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"ftp/common"
+	"os"
+	"strings"
+	"time"
+)
+
+// LIST output formats for Config.ListFormat.
+const (
+	// ListUnix produces `ls -l` style lines, which FileZilla, curl, lftp and
+	// most other clients know how to parse.
+	ListUnix = "unix"
+	// ListPretty produces the human friendly format of the bundled client.
+	ListPretty = "pretty"
+)
+
+// listOptions strips ls style options such as "-la" from a LIST or NLST
+// argument. Many clients send them although RFC 959 only allows a path.
+func listOptions(arg string) string {
+	for {
+		arg = strings.TrimSpace(arg)
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+		_, rest, _ := strings.Cut(arg, " ")
+		arg = rest
+	}
+}
+
+// readListing returns the entries to list for name: the contents of a
+// directory, leaving out uploads in progress, or the file itself.
+func readListing(fsys FileSystem, name string) ([]os.FileInfo, error) {
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []os.FileInfo{info}, nil
+	}
+
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if isTempUpload(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// formatListLine formats one LIST entry, without the line ending.
+func formatListLine(info os.FileInfo, format string, now time.Time) string {
+	if format == ListPretty {
+		itemType := "File"
+		if info.IsDir() {
+			itemType = "Folder"
+		}
+		sizeStr := common.HumanReadableSize(info.Size())
+		modTime := info.ModTime().Format("Jan _2 15:04")
+		return fmt.Sprintf("%-6s %-10s %-20s %s", itemType, sizeStr, modTime, info.Name())
+	}
+
+	// Like ls, show the time for recent files and the year for older ones
+	modTime := info.ModTime()
+	layout := "Jan _2 15:04"
+	if modTime.Before(now.AddDate(0, -6, 0)) || modTime.After(now.Add(time.Hour)) {
+		layout = "Jan _2  2006"
+	}
+	// Owner and group are not meaningful to FTP users, so like many servers
+	// we always report "ftp"
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", fileModeToStr(info.Mode()), info.Size(), modTime.Format(layout), info.Name())
+}
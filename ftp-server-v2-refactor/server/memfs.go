@@ -0,0 +1,368 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+// MemFileSystem is a FileSystem held in memory, handy for tests and for
+// serving generated content. The zero value is not usable; call
+// NewMemFileSystem.
+type MemFileSystem struct {
+	mu sync.Mutex
+	// nodes maps every virtual path, including "/", to its file or directory
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir     bool
+	data    []byte
+	perm    fs.FileMode
+	modTime time.Time
+}
+
+// NewMemFileSystem returns an empty in-memory filesystem.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{nodes: map[string]*memNode{
+		"/": {dir: true, perm: 0755, modTime: time.Now()},
+	}}
+}
+
+// WriteFile creates or replaces the file name, creating any missing parent
+// directories.
+func (m *MemFileSystem) WriteFile(name string, data []byte) error {
+	name = path.Clean("/" + name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		n, ok := m.nodes[dir]
+		if !ok {
+			m.nodes[dir] = &memNode{dir: true, perm: 0755, modTime: now}
+			continue
+		}
+		if !n.dir {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+		}
+	}
+	if n, ok := m.nodes[name]; ok && n.dir {
+		return &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	m.nodes[name] = &memNode{data: slices.Clone(data), perm: 0644, modTime: now}
+	return nil
+}
+
+// parent checks that the parent of name is a directory. m.mu must be held.
+func (m *MemFileSystem) parent(op, name string) error {
+	n, ok := m.nodes[path.Dir(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !n.dir {
+		return &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return nil
+}
+
+// children returns the paths of the entries of dir, sorted. m.mu must be held.
+func (m *MemFileSystem) children(dir string) []string {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	var names []string
+	for p := range m.nodes {
+		if p != "/" && path.Dir(p) == dir && strings.HasPrefix(p, prefix) {
+			names = append(names, p)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (m *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return n.info(path.Base(name)), nil
+}
+
+func (m *MemFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	var entries []fs.DirEntry
+	for _, p := range m.children(name) {
+		entries = append(entries, fs.FileInfoToDirEntry(m.nodes[p].info(path.Base(p))))
+	}
+	return entries, nil
+}
+
+func (m *MemFileSystem) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	n, ok := m.nodes[name]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case ok && n.dir && writing:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if err := m.parent("open", name); err != nil {
+			return nil, err
+		}
+		n = &memNode{perm: perm.Perm(), modTime: time.Now()}
+		m.nodes[name] = n
+	}
+	if flag&os.O_TRUNC != 0 && writing {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &memFile{m: m, node: n, name: path.Base(name), flag: flag}, nil
+}
+
+func (m *MemFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[name]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := m.parent("mkdir", name); err != nil {
+		return err
+	}
+	m.nodes[name] = &memNode{dir: true, perm: perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[name]
+	switch {
+	case !ok:
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	case name == "/":
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	case n.dir && len(m.children(name)) > 0:
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFileSystem) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	n, ok := m.nodes[oldname]
+	if !ok {
+		return linkErr(fs.ErrNotExist)
+	}
+	if oldname == "/" || strings.HasPrefix(newname, oldname+"/") {
+		return linkErr(fs.ErrInvalid)
+	}
+	if err := m.parent("rename", newname); err != nil {
+		return linkErr(err.(*fs.PathError).Err)
+	}
+	if target, ok := m.nodes[newname]; ok && oldname != newname {
+		if target.dir {
+			return linkErr(fs.ErrExist)
+		}
+		if n.dir {
+			return linkErr(errNotDir)
+		}
+	}
+
+	m.nodes[newname] = n
+	if oldname == newname {
+		return nil
+	}
+	delete(m.nodes, oldname)
+	if n.dir {
+		// Move everything below the directory along with it
+		for p, child := range m.nodes {
+			if rest, ok := strings.CutPrefix(p, oldname+"/"); ok {
+				delete(m.nodes, p)
+				m.nodes[path.Join(newname, rest)] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	if !mtime.IsZero() {
+		n.modTime = mtime
+	}
+	return nil
+}
+
+// info returns a snapshot of the node. The caller holds the lock.
+func (n *memNode) info(name string) fs.FileInfo {
+	mode := n.perm
+	if n.dir {
+		mode |= fs.ModeDir
+	}
+	return memFileInfo{name: name, size: int64(len(n.data)), mode: mode, modTime: n.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return nil }
+
+// memFile is an open MemFileSystem file. Like an open file on disk it keeps
+// referring to the same data if it is renamed or removed.
+type memFile struct {
+	m      *MemFileSystem
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	case f.node.dir:
+		return &fs.PathError{Op: op, Path: f.name, Err: errIsDir}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	case !write && f.flag&os.O_WRONLY != 0:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"testing"
+)
+
+// readMemFile returns the content of name, failing the test if it cannot be
+// read.
+func readMemFile(t *testing.T, fsys FileSystem, name string) string {
+	t.Helper()
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// dirNames returns the names of the entries of dir.
+func dirNames(t *testing.T, fsys FileSystem, dir string) []string {
+	t.Helper()
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestMemFileSystemRenameDir(t *testing.T) {
+	m := NewMemFileSystem()
+	m.WriteFile("/a/b/f.txt", []byte("f"))
+	m.WriteFile("/a/g.txt", []byte("g"))
+	m.WriteFile("/ab.txt", []byte("not a child of /a"))
+
+	if err := m.Rename("/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/c/b/f.txt"); got != "f" {
+		t.Errorf("/c/b/f.txt = %q", got)
+	}
+	if got := dirNames(t, m, "/c"); !slices.Equal(got, []string{"b", "g.txt"}) {
+		t.Errorf("ReadDir(/c) = %v", got)
+	}
+	if got := dirNames(t, m, "/"); !slices.Equal(got, []string{"ab.txt", "c"}) {
+		t.Errorf("ReadDir(/) = %v", got)
+	}
+	for _, name := range []string{"/a", "/a/b", "/a/b/f.txt", "/a/g.txt"} {
+		if _, err := m.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%s) after rename: %v", name, err)
+		}
+	}
+
+	if err := m.Rename("/c", "/c/b/inside"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("moving a directory into itself: %v", err)
+	}
+	m.Mkdir("/d", 0755)
+	if err := m.Rename("/c", "/d"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("renaming over a directory: %v", err)
+	}
+	if err := m.Rename("/c", "/ab.txt"); err == nil {
+		t.Error("renaming a directory over a file succeeded")
+	}
+	if err := m.Rename("/c/g.txt", "/missing/g.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("renaming into a missing directory: %v", err)
+	}
+
+	// A file replaces a file
+	if err := m.Rename("/c/g.txt", "/ab.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/ab.txt"); got != "g" {
+		t.Errorf("/ab.txt = %q after rename over it", got)
+	}
+}
+
+func TestMemFileSystemOpenFlags(t *testing.T) {
+	m := NewMemFileSystem()
+	excl := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+
+	f, err := m.OpenFile("/new.txt", excl, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("one"))
+	f.Close()
+	if _, err := m.OpenFile("/new.txt", excl, 0600); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("O_EXCL on an existing file: %v", err)
+	}
+	if _, err := m.OpenFile("/", excl, 0600); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("O_EXCL on the root: %v", err)
+	}
+	if _, err := m.OpenFile("/none/new.txt", excl, 0600); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("creating in a missing directory: %v", err)
+	}
+	if _, err := m.OpenFile("/new.txt/x", excl, 0600); err == nil {
+		t.Error("creating below a file succeeded")
+	}
+	if _, err := m.Open("/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(missing): %v", err)
+	}
+	if _, err := m.OpenFile("/", os.O_WRONLY, 0); err == nil {
+		t.Error("opening a directory for writing succeeded")
+	}
+	if info, _ := m.Stat("/new.txt"); info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", info.Mode())
+	}
+
+	f, _ = m.OpenFile("/new.txt", os.O_WRONLY|os.O_APPEND, 0)
+	f.Seek(0, io.SeekStart)
+	f.Write([]byte("two"))
+	f.Close()
+	if got := readMemFile(t, m, "/new.txt"); got != "onetwo" {
+		t.Errorf("after O_APPEND: %q", got)
+	}
+
+	f, _ = m.OpenFile("/new.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	f.Close()
+	if got := readMemFile(t, m, "/new.txt"); got != "" {
+		t.Errorf("after O_TRUNC: %q", got)
+	}
+
+	f, _ = m.Open("/new.txt")
+	if _, err := f.Write([]byte("x")); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("writing a file opened read-only: %v", err)
+	}
+	f.Close()
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("reading a closed file: %v", err)
+	}
+}
+
+func TestMemFileSystemSeekAndTruncate(t *testing.T) {
+	m := NewMemFileSystem()
+	m.WriteFile("/f", []byte("hello"))
+	f, err := m.OpenFile("/f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Reading past the end gives EOF; writing there fills the gap with zeros
+	if _, err := f.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Read(make([]byte, 4)); n != 0 || err != io.EOF {
+		t.Errorf("Read past the end = %d, %v", n, err)
+	}
+	f.Write([]byte("!"))
+	if got := readMemFile(t, m, "/f"); got != "hello\x00\x00\x00!" {
+		t.Errorf("after writing past the end: %q", got)
+	}
+
+	if pos, _ := f.Seek(-2, io.SeekEnd); pos != 7 {
+		t.Errorf("Seek(-2, end) = %d, want 7", pos)
+	}
+	if pos, _ := f.Seek(1, io.SeekCurrent); pos != 8 {
+		t.Errorf("Seek(1, current) = %d, want 8", pos)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Seek(-1): %v", err)
+	}
+
+	if err := f.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/f"); got != "he" {
+		t.Errorf("after Truncate(2): %q", got)
+	}
+	if err := f.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/f"); got != "he\x00\x00" {
+		t.Errorf("after Truncate(4): %q", got)
+	}
+	if info, _ := f.Stat(); info.Size() != 4 {
+		t.Errorf("Stat().Size() = %d, want 4", info.Size())
+	}
+	if err := f.Truncate(-1); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Truncate(-1): %v", err)
+	}
+}
+
+func TestMemFileSystemRemove(t *testing.T) {
+	m := NewMemFileSystem()
+	m.WriteFile("/dir/f.txt", []byte("data"))
+	m.Mkdir("/empty", 0755)
+
+	if err := m.Remove("/dir"); err == nil {
+		t.Error("removing a directory that is not empty succeeded")
+	}
+	if err := m.Remove("/"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("removing the root: %v", err)
+	}
+	if err := m.Remove("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("removing a missing file: %v", err)
+	}
+	if err := m.Remove("/empty"); err != nil {
+		t.Errorf("removing an empty directory: %v", err)
+	}
+
+	// An open file stays readable after it is removed
+	f, err := m.Open("/dir/f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := m.Remove("/dir/f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(f); string(data) != "data" {
+		t.Errorf("read %q from the removed file", data)
+	}
+	if err := m.Remove("/dir"); err != nil {
+		t.Errorf("removing the now empty directory: %v", err)
+	}
+}
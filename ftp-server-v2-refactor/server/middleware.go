@@ -0,0 +1,212 @@
+package server
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// commandHandler runs a command looked up in the command table.
+type commandHandler func(s *Session, c *command, arg string)
+
+// middleware wraps a commandHandler with a policy that applies to every
+// command, e.g. a check that may answer instead of running the command.
+type middleware func(next commandHandler) commandHandler
+
+// runCommand is the innermost handler: the command itself.
+func runCommand(s *Session, c *command, arg string) {
+	c.run(s, arg)
+}
+
+// commandChain returns the handler every command of a session goes through.
+// The first middleware is the outermost.
+func commandChain(cfg Config) commandHandler {
+	chain := []middleware{
+		recoverPanics,
+	}
+	if cfg.LogCommands {
+		chain = append(chain, logCommands)
+	}
+	if len(cfg.RateLimits) > 0 {
+		chain = append(chain, rateLimit(cfg.RateLimits))
+	}
+	chain = append(chain,
+		requireLogin,
+		checkArgs,
+		checkPerms,
+		requireProtectedData,
+		requireTLS,
+		enforceEpsvAll,
+	)
+
+	h := commandHandler(runCommand)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
+
+// recoverPanics answers a command that panics with 451 and keeps the session
+// going.
+func recoverPanics(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		defer func() {
+			if r := recover(); r != nil {
+				logf(s.cfg.Logger, "Panic in %s: %v\n%s", c.name, r, debug.Stack())
+				s.reply("451 Requested action aborted: local error in processing")
+			}
+		}()
+		next(s, c, arg)
+	}
+}
+
+// logCommands logs every command with the client and user, hiding
+// passwords.
+func logCommands(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		who := "-"
+		if s.user != nil {
+			who = s.user.Name
+		}
+		line := c.name
+		switch {
+		case c.name == "PASS":
+			line += " ****"
+		case arg != "":
+			line += " " + arg
+		}
+		start := time.Now()
+		// Deferred so that commands that panic are logged too
+		defer func() {
+			logf(s.cfg.Logger, "%s %s: %s (%v)", s.conn.RemoteAddr(), who, line, time.Since(start).Round(time.Microsecond))
+		}()
+		next(s, c, arg)
+	}
+}
+
+// RateLimit lets a session send Burst commands at once and then Rate commands
+// per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateLimit delays commands that come faster than limits allow. limits are
+// by command name; the "*" entry covers commands without their own.
+func rateLimit(limits map[string]RateLimit) middleware {
+	return func(next commandHandler) commandHandler {
+		buckets := map[string]*tokenBucket{}
+		return func(s *Session, c *command, arg string) {
+			name := c.name
+			limit, ok := limits[name]
+			if !ok {
+				name = "*"
+				limit, ok = limits[name]
+			}
+			if ok && limit.Rate > 0 {
+				b := buckets[name]
+				if b == nil {
+					b = newTokenBucket(limit)
+					buckets[name] = b
+				}
+				time.Sleep(b.take(time.Now()))
+			}
+			next(s, c, arg)
+		}
+	}
+}
+
+// tokenBucket holds up to burst tokens and gains rate tokens per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(max(limit.Burst, 1))
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take uses up a token and returns how long to wait until it is available.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// requireLogin rejects commands that need a login until the user has logged
+// in.
+func requireLogin(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		if c.auth && s.user == nil {
+			s.reply("530 Not logged in")
+			return
+		}
+		next(s, c, arg)
+	}
+}
+
+// checkArgs enforces the command's argument rule.
+func checkArgs(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		if c.args == argRequired && arg == "" || c.args == argNone && arg != "" {
+			s.reply("501 Syntax error in parameters or arguments")
+			return
+		}
+		next(s, c, arg)
+	}
+}
+
+// checkPerms checks the user's permission on the path the command acts on.
+func checkPerms(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		if c.perm != PermNone && s.user != nil {
+			target := resolvePath(s.currentDir, permTarget(c.name, arg))
+			if !s.user.PermsAt(target).Has(c.perm) {
+				s.reply(permDeniedReply(c.perm))
+				return
+			}
+		}
+		next(s, c, arg)
+	}
+}
+
+// requireProtectedData refuses transfers over clear data connections when
+// RequireTLS is set.
+func requireProtectedData(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		if c.data && s.cfg.RequireTLS && s.data.tlsConfig == nil {
+			s.reply("521 Data connections must be protected, use PROT P")
+			return
+		}
+		next(s, c, arg)
+	}
+}
+
+// requireTLS refuses commands marked needsTLS on a clear control connection
+// when RequireTLS is set.
+func requireTLS(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		if c.needsTLS && s.cfg.RequireTLS && !s.tlsActive {
+			s.reply("530 TLS required, use AUTH TLS")
+			return
+		}
+		next(s, c, arg)
+	}
+}
+
+// enforceEpsvAll refuses PASV, PORT and EPRT after EPSV ALL.
+func enforceEpsvAll(next commandHandler) commandHandler {
+	return func(s *Session, c *command, arg string) {
+		if c.notAfterEpsvAll && s.epsvAll {
+			s.reply("503 Only EPSV allowed after EPSV ALL")
+			return
+		}
+		next(s, c, arg)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	var logged bytes.Buffer
+	cfg := Config{Logger: log.New(&logged, "", 0)}
+	s, out := newTestSession(t, cfg, &User{Name: "test", Perms: PermFull}, NewMemFileSystem())
+
+	boom := &command{name: "BOOM", run: func(*Session, string) { panic("boom") }}
+	s.handler(s, boom, "")
+	if got := strings.TrimSpace(out.String()); got != "451 Requested action aborted: local error in processing" {
+		t.Errorf("reply %q, want 451", got)
+	}
+	if !strings.Contains(logged.String(), "Panic in BOOM: boom") {
+		t.Errorf("panic not logged: %q", logged.String())
+	}
+
+	// The session carries on
+	if got := run(s, out, "NOOP"); !strings.HasPrefix(got, "200") {
+		t.Errorf("NOOP after a panic: reply %q", got)
+	}
+}
+
+func TestLogCommandsHidesPasswords(t *testing.T) {
+	var logged bytes.Buffer
+	cfg := Config{LogCommands: true, Logger: log.New(&logged, "", 0)}
+	s, out := newTestSession(t, cfg, nil, nil)
+
+	run(s, out, "USER alice")
+	run(s, out, "PASS hunter2")
+	if strings.Contains(logged.String(), "hunter2") {
+		t.Errorf("password logged: %q", logged.String())
+	}
+	for _, want := range []string{"-: USER alice", "-: PASS ****"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log %q lacks %q", logged.String(), want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(RateLimit{Rate: 2, Burst: 3})
+	b.last = start
+
+	// The burst passes at once, then each token takes half a second
+	waits := []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second}
+	for i, want := range waits {
+		if got := b.take(start); got != want {
+			t.Errorf("take %d: wait %v, want %v", i, got, want)
+		}
+	}
+
+	// Idling refills the bucket, but never beyond the burst
+	later := start.Add(time.Hour)
+	for i := range 3 {
+		if got := b.take(later); got != 0 {
+			t.Errorf("take %d after idling: wait %v, want 0", i, got)
+		}
+	}
+	if got := b.take(later); got != 500*time.Millisecond {
+		t.Errorf("take after the refilled burst: wait %v, want 500ms", got)
+	}
+
+	// A burst below one still lets a command through
+	b = newTokenBucket(RateLimit{Rate: 1})
+	b.last = start
+	if got := b.take(start); got != 0 {
+		t.Errorf("first take with zero burst: wait %v", got)
+	}
+}
+
+func TestRateLimitPerCommand(t *testing.T) {
+	limits := map[string]RateLimit{
+		"PASS": {Rate: 1, Burst: 1},
+		"*":    {Rate: 1000, Burst: 100},
+	}
+	cfg := Config{RateLimits: limits}
+	s, out := newTestSession(t, cfg, nil, nil)
+
+	start := time.Now()
+	for range 20 {
+		run(s, out, "NOOP")
+	}
+	run(s, out, "PASS x")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("commands within their limits took %v", elapsed)
+	}
+
+	// The second PASS has to wait for PASS's own bucket
+	start = time.Now()
+	run(s, out, "PASS x")
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("second PASS was delayed only %v", elapsed)
+	}
+}
+
+func TestCheckPermsUsesTarget(t *testing.T) {
+	fsys := NewMemFileSystem()
+	fsys.WriteFile("/in/f.txt", []byte("x"))
+	fsys.WriteFile("/out.txt", []byte("x"))
+	user := &User{Name: "test", Perms: PermFull, WriteOnlyDir: "/in"}
+	s, out := newTestSession(t, Config{}, user, fsys)
+
+	tests := []struct{ line, reply string }{
+		// The path is not the whole argument; checking the argument as a
+		// path would find full permissions
+		{"MFMT 20200101000000 /in/f.txt", "550"},
+		{"MFMT 20200101000000 /out.txt", "213"},
+		{"XCRC /in/f.txt 0 0", "550"},
+		{"XCRC /out.txt 0 0", "250"},
+		{"LIST -l /in", "550"},
+		{"SIZE in/f.txt", "550"},
+	}
+	for _, tt := range tests {
+		if got := run(s, out, tt.line); !strings.HasPrefix(got, tt.reply) {
+			t.Errorf("%s: reply %q, want %s", tt.line, got, tt.reply)
+		}
+	}
+}
+
+func TestPolicyReplies(t *testing.T) {
+	user := &User{Name: "test", Perms: PermFull}
+
+	t.Run("login", func(t *testing.T) {
+		s, out := newTestSession(t, Config{}, nil, NewMemFileSystem())
+		if got := run(s, out, "PWD"); !strings.HasPrefix(got, "530") {
+			t.Errorf("PWD before login: %q", got)
+		}
+	})
+	t.Run("arguments", func(t *testing.T) {
+		s, out := newTestSession(t, Config{}, user, NewMemFileSystem())
+		for _, line := range []string{"NOOP extra", "RETR", "DELE"} {
+			if got := run(s, out, line); !strings.HasPrefix(got, "501") {
+				t.Errorf("%s: %q, want 501", line, got)
+			}
+		}
+	})
+	t.Run("TLS", func(t *testing.T) {
+		cfg := Config{RequireTLS: true, TLSConfig: &tls.Config{}}
+		s, out := newTestSession(t, cfg, nil, NewMemFileSystem())
+		if got := run(s, out, "USER alice"); !strings.HasPrefix(got, "530 TLS required") {
+			t.Errorf("USER over a clear connection: %q", got)
+		}
+		s.tlsActive = true
+		if got := run(s, out, "USER alice"); !strings.HasPrefix(got, "331") {
+			t.Errorf("USER over TLS: %q", got)
+		}
+
+		s.user = user
+		if got := run(s, out, "RETR f.txt"); !strings.HasPrefix(got, "521") {
+			t.Errorf("RETR over a clear data connection: %q", got)
+		}
+	})
+	t.Run("EPSV ALL", func(t *testing.T) {
+		s, out := newTestSession(t, Config{}, user, NewMemFileSystem())
+		if got := run(s, out, "EPSV ALL"); !strings.HasPrefix(got, "200") {
+			t.Fatalf("EPSV ALL: %q", got)
+		}
+		for _, line := range []string{"PASV", "PORT 127,0,0,1,4,1", "EPRT |1|127.0.0.1|1025|"} {
+			if got := run(s, out, line); !strings.HasPrefix(got, "503") {
+				t.Errorf("%s after EPSV ALL: %q, want 503", line, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Perm is a set of operations a user may perform.
+type Perm uint
+
+const (
+	PermList Perm = 1 << iota
+	PermDownload
+	PermUpload
+	PermOverwrite
+	PermDelete
+	PermMkdir
+	PermRename
+)
+
+// Common permission presets.
+const (
+	PermNone       Perm = 0
+	PermReadOnly        = PermList | PermDownload
+	PermUploadOnly      = PermUpload
+	PermFull            = PermList | PermDownload | PermUpload | PermOverwrite | PermDelete | PermMkdir | PermRename
+)
+
+var permNames = []struct {
+	name string
+	perm Perm
+}{
+	{"list", PermList},
+	{"download", PermDownload},
+	{"upload", PermUpload},
+	{"overwrite", PermOverwrite},
+	{"delete", PermDelete},
+	{"mkdir", PermMkdir},
+	{"rename", PermRename},
+}
+
+var permPresets = map[string]Perm{
+	"none":        PermNone,
+	"read-only":   PermReadOnly,
+	"upload-only": PermUploadOnly,
+	"full":        PermFull,
+}
+
+// Has reports whether p includes every permission in q.
+func (p Perm) Has(q Perm) bool {
+	return p&q == q
+}
+
+func (p Perm) String() string {
+	var names []string
+	for _, n := range permNames {
+		if p.Has(n.perm) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParsePerm parses a preset name (none, read-only, upload-only, full) or a
+// comma separated list of permissions such as "list,download,upload".
+func ParsePerm(s string) (Perm, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if p, ok := permPresets[s]; ok {
+		return p, nil
+	}
+	var p Perm
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		found := false
+		for _, n := range permNames {
+			if n.name == field {
+				p |= n.perm
+				found = true
+				break
+			}
+		}
+		if !found {
+			return PermNone, fmt.Errorf("unknown permission %q", field)
+		}
+	}
+	return p, nil
+}
+
+// permTarget returns the part of a command's argument naming the path that
+// permissions are checked against.
+func permTarget(cmd, arg string) string {
+	switch cmd {
+	case "MFMT":
+		_, name, _ := strings.Cut(arg, " ")
+		return strings.TrimSpace(name)
+	case "LIST", "NLST":
+		return listOptions(arg)
+	case "XCRC", "XMD5", "XSHA1", "XSHA256":
+		name, _ := parseXHashArg(arg)
+		return name
+	}
+	return arg
+}
+
+// permDeniedReply returns the reply sent when a user lacks perm.
+func permDeniedReply(perm Perm) string {
+	if perm == PermUpload {
+		return "532 Need account for storing files"
+	}
+	return "550 Permission denied"
+}
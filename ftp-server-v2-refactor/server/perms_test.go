@@ -0,0 +1,42 @@
+package server
+
+import "testing"
+
+func TestParsePerm(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Perm
+		wantErr bool
+	}{
+		{"none", PermNone, false},
+		{"read-only", PermReadOnly, false},
+		{"upload-only", PermUploadOnly, false},
+		{"full", PermFull, false},
+		{" Full ", PermFull, false},
+		{"list", PermList, false},
+		{"list,download,upload", PermList | PermDownload | PermUpload, false},
+		{"rename, mkdir ,DELETE", PermRename | PermMkdir | PermDelete, false},
+		{"overwrite,overwrite", PermOverwrite, false},
+		{"", PermNone, true},
+		{"list,", PermNone, true},
+		{",list", PermNone, true},
+		{"read", PermNone, true},
+		{"full,list", PermNone, true},
+		{"list;download", PermNone, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePerm(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePerm(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPermStringRoundTrip(t *testing.T) {
+	for _, p := range []Perm{PermNone, PermList, PermReadOnly, PermUploadOnly, PermList | PermRename, PermFull} {
+		got, err := ParsePerm(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParsePerm(%q) = %v, %v; want %v", p.String(), got, err, p)
+		}
+	}
+}
@@ -1,204 +1,343 @@
 package server
 
 import (
-	"bufio"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
 	"net"
-	"strings"
-	"os"
-	"path/filepath"
-	"io"
+	"sync"
+	"time"
 )
 
-func StartServer_(port int, timeout int, verbose bool) {
-	if verbose {
-		println("Verbose logging enabled")
-	}
-	println("Starting server on port:", port)
-	println("Timeout set to:", timeout, "seconds")
-	// Placeholder for actual server logic
+// Config holds the settings of a Server. See also the Option functions.
+type Config struct {
+	// SharedDir is the directory served to clients.
+	SharedDir string
+	// Addr is the address of the control listener, e.g. ":2121".
+	Addr string
+	// Auth verifies USER/PASS. If nil every login is rejected.
+	Auth Authenticator
+	// AnonDir enables anonymous logins (USER anonymous or ftp with an email
+	// address as password) and is the read-only root they see. A relative
+	// AnonDir is resolved against SharedDir.
+	AnonDir string
+	// AnonIncoming is a directory below AnonDir where anonymous users may
+	// upload new files but not list or download them. Empty disables
+	// anonymous uploads.
+	AnonIncoming string
+	// PassivePorts limits the ports used for PASV/EPSV data listeners. The
+	// zero value lets the OS pick any free port.
+	PassivePorts PortRange
+	// PassiveAddr is the address advertised in PASV replies: an IPv4
+	// address or hostname (e.g. the public address of a NAT gateway),
+	// "control" to echo the local address of the control connection, or
+	// empty to use the first non-loopback IPv4 address of this host.
+	PassiveAddr string
+	// TLSConfig enables explicit FTPS (AUTH TLS, PBSZ, PROT). See
+	// LoadTLSConfig and SelfSignedTLSConfig.
+	TLSConfig *tls.Config
+	// RequireTLS rejects logins over a plaintext control connection and
+	// transfers over unprotected data connections.
+	RequireTLS bool
+	// ImplicitAddr, if set, is the address of a second listener for implicit
+	// FTPS, where connections use TLS from the first byte and data
+	// connections are always protected. Needs TLSConfig.
+	ImplicitAddr string
+	// ListFormat selects the LIST output: ListUnix (the default) or
+	// ListPretty.
+	ListFormat string
+	// ModeZLevel enables MODE Z, deflate compressed data connections, at
+	// this compression level from 1 (fastest) to 9 (smallest). Clients can
+	// change it with OPTS MODE Z LEVEL. 0 disables MODE Z.
+	ModeZLevel int
+	// FileSystem, if set, returns the tree served to a logged in user in
+	// place of their home directory below SharedDir, e.g. a
+	// MemFileSystem or a FileSystem wrapped in ReadOnly. User permissions
+	// still apply on top of it. It is called at every login; if the result
+	// is an io.Closer it is closed when the session ends.
+	FileSystem func(user *User) (FileSystem, error)
+	// LogCommands prints every command received, with passwords hidden.
+	LogCommands bool
+	// RateLimits slows down sessions sending commands faster than allowed.
+	// Keys are command names, e.g. "PASS"; the "*" entry applies to all
+	// commands without their own entry. Commands over the limit are delayed.
+	RateLimits map[string]RateLimit
+	// IdleTimeout closes control connections that send no command for this
+	// long while no transfer is running. 0 means no limit.
+	IdleTimeout time.Duration
+	// DataTimeout bounds how long a data connection may take to open. 0
+	// means 30 seconds.
+	DataTimeout time.Duration
+	// Logger receives the server's log messages. If nil the standard
+	// logger of the log package is used.
+	Logger *log.Logger
 }
 
-func StartServer(sharedDir string, port *string) {
-	ln, err := net.Listen("tcp", *port)
-	if err != nil {
-		fmt.Print("Error listening:", err)
-		return
-	}
-	defer ln.Close()
-	fmt.Printf("Server listening on %s serving %s", *port, sharedDir)
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println("Accept error:", err)
-			continue
-		}
-		fmt.Println("Client connected")
-		go handleConnection(conn, sharedDir)
+// logf logs to logger, or to the standard logger if it is nil.
+func logf(logger *log.Logger, format string, v ...any) {
+	if logger == nil {
+		logger = log.Default()
 	}
+	logger.Printf(format, v...)
 }
 
-func handleConnection(conn net.Conn, sharedDir string) {
-	var dataListener net.Listener
-
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
-	sendLine(writer, "220 Simple FTP server ready")
+// ErrServerClosed is returned by Serve and ListenAndServe once Shutdown has
+// been called or the context of ListenAndServe is done.
+var ErrServerClosed = errors.New("ftp: server closed")
+
+// Server is an FTP server that can be embedded in other programs. Create it
+// with NewServer.
+type Server struct {
+	cfg Config
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	// done is closed once the server is shutting down
+	done     chan struct{}
+	sessions sync.WaitGroup
+}
 
-	authenticated := false
+// Option configures a Server.
+type Option func(*Config)
+
+// NewServer returns a server configured by opts. Without options it serves
+// the working directory on :2121, rejects every login and offers MODE Z at
+// level 6, as the command line does.
+func NewServer(opts ...Option) *Server {
+	cfg := Config{
+		SharedDir:  ".",
+		Addr:       ":2121",
+		ListFormat: ListUnix,
+		ModeZLevel: 6,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Server{
+		cfg:       cfg,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+		done:      make(chan struct{}),
+	}
+}
 
-	rootDir := sharedDir
-	currentDir := sharedDir //"./"
+// WithConfig replaces all settings with cfg. Options after it still apply.
+func WithConfig(cfg Config) Option {
+	return func(c *Config) { *c = cfg }
+}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err != io.EOF {
-				fmt.Println("Read error:", err)
-			}
-			break
-		}
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+// WithAddr sets the address ListenAndServe listens on, e.g. ":2121".
+func WithAddr(addr string) Option {
+	return func(c *Config) { c.Addr = addr }
+}
 
-		cmd, arg := parseCmd(line)
+// WithRoot sets the host directory served to clients.
+func WithRoot(dir string) Option {
+	return func(c *Config) { c.SharedDir = dir }
+}
 
-		switch strings.ToUpper(cmd) {
-		case "HELP":
-			handleHelpCommand(writer)
+// WithAuth sets the Authenticator that checks USER/PASS.
+func WithAuth(auth Authenticator) Option {
+	return func(c *Config) { c.Auth = auth }
+}
 
-		case "USER":
-			handleUserCommand(writer, arg)
+// WithFileSystem serves the FileSystem returned by fn instead of a host
+// directory. See Config.FileSystem.
+func WithFileSystem(fn func(user *User) (FileSystem, error)) Option {
+	return func(c *Config) { c.FileSystem = fn }
+}
 
-		case "PASS":
-			// For simplicity, accept any password
-			authenticated = true
-			sendLine(writer, "230 User logged in")
+// WithTLS enables explicit FTPS with config. If required is set, logins and
+// transfers without TLS are refused.
+func WithTLS(config *tls.Config, required bool) Option {
+	return func(c *Config) {
+		c.TLSConfig = config
+		c.RequireTLS = required
+	}
+}
 
-		case "PWD":
-			if !authenticated {
-				sendLine(writer, "530 Not logged in")
-				continue
-			}
-			sendLine(writer, fmt.Sprintf("257 \"%s\"", currentDir))
-
-		case "OLD_CWD":
-			newDir := filepath.Join(currentDir, arg)
-			if _, err := os.Stat(newDir); err != nil {
-				sendLine(writer, "550 Directory not found")
-			} else {
-				currentDir = newDir
-				sendLine(writer, "250 Directory changed")
-			}
+// WithImplicitTLS makes ListenAndServe also listen for implicit FTPS on addr.
+// It needs WithTLS.
+func WithImplicitTLS(addr string) Option {
+	return func(c *Config) { c.ImplicitAddr = addr }
+}
 
-		case "CWD":
-			// TODO: implement cwd handler 
-			if !authenticated {
-				sendLine(writer, "530 Not logged in")
-				continue
-			}
+// WithTimeouts sets Config.IdleTimeout and Config.DataTimeout.
+func WithTimeouts(idle, data time.Duration) Option {
+	return func(c *Config) {
+		c.IdleTimeout = idle
+		c.DataTimeout = data
+	}
+}
 
-			handleCwdCommand(writer, arg, rootDir, &currentDir)
+// WithLogger sends log messages to logger. Use log.New(io.Discard, "", 0) to
+// silence the server.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
 
-		case "CDUP":
-			if !authenticated {
-				sendLine(writer, "530 Not logged in")
-				continue
-			}
-			handleCdupCommand(writer, rootDir, &currentDir)
+// ListenAndServe listens on the configured address, and the implicit FTPS
+// address if set, and serves until ctx is done or Shutdown is called. Ending
+// ctx stops the server like Shutdown but does not wait for sessions to end.
+// It always returns a non-nil error, ErrServerClosed after a shutdown.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	cfg := srv.cfg
+	if cfg.ImplicitAddr != "" && cfg.TLSConfig == nil {
+		return errors.New("implicit FTPS needs a TLS configuration")
+	}
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	logf(cfg.Logger, "Server listening on %s serving %s", ln.Addr(), cfg.SharedDir)
 
+	listeners := []net.Listener{ln}
+	if cfg.ImplicitAddr != "" {
+		implicitLn, err := net.Listen("tcp", cfg.ImplicitAddr)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		logf(cfg.Logger, "Implicit FTPS listening on %s", implicitLn.Addr())
+		listeners = append(listeners, implicitLn)
+	}
 
-		case "LIST":
-			if !authenticated {
-				sendLine(writer, "530 Not logged in")
-				continue
-			}
-			handleListCommand(writer, currentDir, &dataListener)
+	stop := context.AfterFunc(ctx, srv.close)
+	defer stop()
 
-		case "RETR":
-			if !authenticated {
-				sendLine(writer, "530 Not logged in")
-				continue
-			}
-			handleRetrCommand(writer, arg, currentDir, &dataListener)
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func() { errs <- srv.serve(l, i == 1) }()
+	}
+	err = <-errs
+	// If one listener fails, stop the other too
+	for _, l := range listeners {
+		l.Close()
+	}
+	for range len(listeners) - 1 {
+		<-errs
+	}
+	return err
+}
 
-		case "STOR":
-			if !authenticated {
-				sendLine(writer, "530 Not logged in")
-				continue
-			}
-			if arg == "" {
-				sendLine(writer, "501 Syntax error in parameters or arguments")
-				continue
-			}
-			if dataListener == nil {
-				sendLine(writer, "425 Use PASV first")
-				continue
-			}
+// Serve accepts control connections on ln until Shutdown is called. It
+// always returns a non-nil error, ErrServerClosed after a shutdown.
+func (srv *Server) Serve(ln net.Listener) error {
+	return srv.serve(ln, false)
+}
 
-			// Path for uploaded file
-			filePath := filepath.Join(currentDir, arg)
+// serve accepts control connections on ln. implicitTLS wraps them in TLS
+// from the first byte.
+func (srv *Server) serve(ln net.Listener, implicitTLS bool) error {
+	if !srv.track(ln, nil, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer srv.track(ln, nil, false)
+	if implicitTLS {
+		ln = tls.NewListener(ln, srv.cfg.TLSConfig)
+	}
 
-			// Create or overwrite the file
-			f, err := os.Create(filePath)
-			if err != nil {
-				sendLine(writer, "550 Cannot create file")
-				continue
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
 			}
-
-			sendLine(writer, "150 Opening data connection for file upload")
-
-			// Accept incoming data connection
-			dataConn, err := dataListener.Accept()
-			if err != nil {
-				sendLine(writer, "425 Can't open data connection")
-				dataListener.Close()
-				dataListener = nil
-				f.Close()
-				continue
+			if errors.Is(err, net.ErrClosed) {
+				return err
 			}
+			// e.g. out of file descriptors; try again shortly
+			logf(srv.cfg.Logger, "Accept error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !srv.track(nil, conn, true) {
+			conn.Close()
+			continue
+		}
+		logf(srv.cfg.Logger, "Client connected from %s", conn.RemoteAddr())
+		go func() {
+			defer srv.track(nil, conn, false)
+			newSession(conn, srv.cfg, implicitTLS, srv.done).serve()
+		}()
+	}
+}
 
-			// Copy data from client to file
-			_, copyErr := io.Copy(f, dataConn)
-
-			f.Close()
-			dataConn.Close()
-			dataListener.Close()
-			dataListener = nil
-
-			if copyErr != nil {
-				sendLine(writer, "426 Connection closed; transfer aborted")
-				continue
-			}
+// track adds or removes a listener or connection. Adding fails once the
+// server is shutting down.
+func (srv *Server) track(ln net.Listener, conn net.Conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	switch {
+	case add && srv.closed:
+		return false
+	case ln != nil && add:
+		srv.listeners[ln] = struct{}{}
+	case ln != nil:
+		delete(srv.listeners, ln)
+	case add:
+		srv.conns[conn] = struct{}{}
+		srv.sessions.Add(1)
+	default:
+		delete(srv.conns, conn)
+		srv.sessions.Done()
+	}
+	return true
+}
 
-			sendLine(writer, "226 Transfer complete")
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
 
-		case "PASV":
-			// Listen on any available port
-			dataListener, err = net.Listen("tcp", "0.0.0.0:0")
-			if err != nil {
-				sendLine(writer, "425 Can't open data connection")
-				continue
-			}
+// close stops the listeners and tells sessions to end.
+func (srv *Server) close() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return
+	}
+	srv.closed = true
+	close(srv.done)
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+}
 
-			// Get the port
-			addr := dataListener.Addr().(*net.TCPAddr)
-			p1 := addr.Port / 256
-			p2 := addr.Port % 256
-
-			// Send PASV response with server IP and port
-			hostIP := getLANIP() // "127,0,0,1" // You should get the actual IP of your server here
-			sendLine(writer, fmt.Sprintf("227 Entering Passive Mode (%s,%d,%d)", hostIP, p1, p2))
-		case "QUIT":
-			sendLine(writer, "221 Goodbye")
-			return
-		default:
-			sendLine(writer, "502 Command not implemented")
+// Shutdown stops accepting connections and waits for the sessions to end.
+// Idle sessions are closed with a 421 reply right away, others once their
+// running transfer has finished. If ctx ends first the remaining connections
+// are closed and ctx's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.close()
+
+	finished := make(chan struct{})
+	go func() {
+		srv.sessions.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		srv.mu.Lock()
+		for conn := range srv.conns {
+			conn.Close()
 		}
+		srv.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// StartServer serves cfg until the listener fails. It is a shorthand for
+// NewServer(WithConfig(cfg)).ListenAndServe.
+func StartServer(cfg Config) {
+	if err := NewServer(WithConfig(cfg)).ListenAndServe(context.Background()); err != nil {
+		logf(cfg.Logger, "Server stopped: %v", err)
 	}
 }
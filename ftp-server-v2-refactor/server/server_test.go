@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAuth struct{}
+
+func (testAuth) Authenticate(username, password string) (*User, error) {
+	if username != "test" || password != "secret" {
+		return nil, errors.New("invalid credentials")
+	}
+	return &User{Name: username, Perms: PermFull}, nil
+}
+
+// startTestServer serves fsys on a local port and returns its address.
+func startTestServer(t *testing.T, fsys FileSystem, opts ...Option) (*Server, string, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]Option{
+		WithAuth(testAuth{}),
+		WithFileSystem(func(*User) (FileSystem, error) { return fsys, nil }),
+		WithLogger(log.New(io.Discard, "", 0)),
+	}, opts...)
+	srv := NewServer(opts...)
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(ln) }()
+	return srv, ln.Addr().String(), errs
+}
+
+// testClient sends a command and returns the reply, skipping the lines of
+// multi-line replies.
+func testClient(t *testing.T, addr string) func(cmd string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return "error: " + err.Error()
+			}
+			if len(line) < 4 || line[3] != '-' {
+				return strings.TrimSpace(line)
+			}
+		}
+	}
+	if greeting := read(); !strings.HasPrefix(greeting, "220") {
+		t.Fatalf("greeting %q", greeting)
+	}
+	return func(cmd string) string {
+		if cmd != "" {
+			conn.Write([]byte(cmd + "\r\n"))
+		}
+		return read()
+	}
+}
+
+func TestServerServeAndShutdown(t *testing.T) {
+	fsys := NewMemFileSystem()
+	fsys.WriteFile("/hello.txt", []byte("hello"))
+	srv, addr, errs := startTestServer(t, fsys)
+
+	send := testClient(t, addr)
+	for _, step := range []struct{ cmd, want string }{
+		{"USER test", "331"},
+		{"PASS wrong", "530"},
+		{"USER test", "331"},
+		{"PASS secret", "230"},
+		{"SIZE hello.txt", "213 5"},
+	} {
+		if got := send(step.cmd); !strings.HasPrefix(got, step.want) {
+			t.Fatalf("%s: reply %q, want %s", step.cmd, got, step.want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if got := send(""); !strings.HasPrefix(got, "421") {
+		t.Errorf("idle session got %q on shutdown, want 421", got)
+	}
+	if err := <-errs; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("server still accepts connections after Shutdown")
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	srv, addr, _ := startTestServer(t, NewMemFileSystem(), WithTimeouts(50*time.Millisecond, 0))
+	defer srv.Shutdown(context.Background())
+
+	send := testClient(t, addr)
+	if got := send(""); !strings.HasPrefix(got, "421") {
+		t.Errorf("got %q after idling, want 421", got)
+	}
+}
+
+func TestServerListenAndServeContext(t *testing.T) {
+	srv := NewServer(WithAddr("127.0.0.1:0"), WithLogger(log.New(io.Discard, "", 0)))
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe(ctx) }()
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ListenAndServe returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return after the context ended")
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Session is the state of one control connection. Commands are looked up in
+// the command table and run against it.
+type Session struct {
+	cfg Config
+	// conn is replaced by a TLS connection after AUTH TLS
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	data   dataChannel
+
+	user     *User
+	username string
+
+	// fsys is the tree served to the logged in user and currentDir is the
+	// working directory in it, always starting with "/".
+	fsys       FileSystem
+	currentDir string
+
+	// After "EPSV ALL" the client promises to only use EPSV
+	epsvAll bool
+
+	// renameFrom is set by RNFR and only valid for the command right after,
+	// which sees it as pendingRename
+	renameFrom    string
+	pendingRename string
+
+	// restOffset is set by REST and used up by the next RETR, STOR or APPE
+	restOffset int64
+
+	// facts are the MLST/MLSD facts selected with OPTS MLST
+	facts []string
+
+	// hashAlg is the algorithm used by HASH, chosen with OPTS HASH, and
+	// hashRange the range set by RANG for the next HASH
+	hashAlg   string
+	hashRange *byteRange
+
+	// transferType is the representation type set with TYPE, "A" (the
+	// RFC 959 default) or "I"
+	transferType string
+
+	implicitTLS bool
+	tlsActive   bool
+	pbszSet     bool
+
+	// current is the transfer running in the background, if any. Its final
+	// reply is sent when it ends, between replies to other commands.
+	current *transfer
+
+	// closing ends the session after the current command
+	closing bool
+
+	// handler runs commands through the middleware chain
+	handler commandHandler
+
+	// shutdown is closed when the server shuts down
+	shutdown <-chan struct{}
+}
+
+func newSession(conn net.Conn, cfg Config, implicitTLS bool, shutdown <-chan struct{}) *Session {
+	s := &Session{
+		cfg:          cfg,
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		writer:       bufio.NewWriter(conn),
+		currentDir:   "/",
+		facts:        mlstFacts,
+		hashAlg:      hashAlgorithms[0].name,
+		transferType: "A",
+		implicitTLS:  implicitTLS,
+		tlsActive:    implicitTLS,
+		pbszSet:      implicitTLS,
+		handler:      commandChain(cfg),
+		shutdown:     shutdown,
+	}
+	if implicitTLS {
+		s.data.tlsConfig = cfg.TLSConfig
+	}
+	s.data.compressLevel = cfg.ModeZLevel
+	s.data.timeout = cfg.DataTimeout
+	s.data.logger = cfg.Logger
+	s.data.peerIP = connIP(conn.RemoteAddr())
+	return s
+}
+
+func (s *Session) reply(line string) {
+	sendLine(s.writer, line)
+}
+
+// controlLine is a line read from the control connection.
+type controlLine struct {
+	text string
+	err  error
+}
+
+func readLine(reader *bufio.Reader, lines chan<- controlLine) {
+	text, err := reader.ReadString('\n')
+	lines <- controlLine{text, err}
+}
+
+// serve runs the session until the client quits or disconnects.
+func (s *Session) serve() {
+	defer func() { s.conn.Close() }()
+	defer s.data.reset()
+	defer func() { closeFileSystem(s.fsys) }()
+	defer func() {
+		if s.current != nil {
+			s.current.abort()
+			<-s.current.done
+		}
+	}()
+
+	s.reply("220 Simple FTP server ready")
+
+	// The next line is read in the background so we can wait for it and the
+	// end of a transfer at the same time. Reading only starts once the
+	// previous command has been handled, as AUTH TLS replaces reader.
+	lines := make(chan controlLine, 1)
+	reading := false
+
+	idleTimer := time.NewTimer(0)
+	idleTimer.Stop()
+	defer idleTimer.Stop()
+
+	for !s.closing {
+		if !reading {
+			reading = true
+			go readLine(s.reader, lines)
+		}
+		// A running transfer holds off the idle timeout and shutdown
+		var transferDone chan string
+		var idle <-chan time.Time
+		shutdown := s.shutdown
+		if s.current != nil {
+			transferDone = s.current.done
+			shutdown = nil
+		} else if s.cfg.IdleTimeout > 0 {
+			idleTimer.Reset(s.cfg.IdleTimeout)
+			idle = idleTimer.C
+		}
+
+		select {
+		case <-idle:
+			s.reply("421 Idle timeout, closing control connection")
+			return
+		case <-shutdown:
+			s.reply("421 Server shutting down")
+			return
+		case reply := <-transferDone:
+			s.reply(reply)
+			s.current = nil
+		case l := <-lines:
+			reading = false
+			if l.err != nil {
+				if l.err != io.EOF {
+					logf(s.cfg.Logger, "Read error: %v", l.err)
+				}
+				return
+			}
+			if line := strings.TrimSpace(stripTelnet(l.text)); line != "" {
+				s.dispatch(line)
+			}
+		}
+	}
+}
+
+// dispatch runs one command line through the session's middleware chain.
+func (s *Session) dispatch(line string) {
+	name, arg := parseCmd(line)
+	name = strings.ToUpper(name)
+	c := commands[name]
+
+	// Other commands wait for a running transfer to finish
+	if s.current != nil && (c == nil || !c.duringTransfer) {
+		s.reply(<-s.current.done)
+		s.current = nil
+	}
+
+	// RNTO must immediately follow RNFR
+	s.pendingRename = s.renameFrom
+	s.renameFrom = ""
+
+	if c == nil {
+		s.reply("502 Command not implemented")
+		return
+	}
+	s.handler(s, c, arg)
+}
+
+// startTLS answers AUTH and on success switches the control connection to
+// TLS.
+func (s *Session) startTLS(arg string) {
+	if s.user != nil {
+		s.reply("503 AUTH must come before login")
+		return
+	}
+	if !handleAuthCommand(s.writer, arg, s.cfg, s.tlsActive) {
+		return
+	}
+	tlsConn := tls.Server(s.conn, s.cfg.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		logf(s.cfg.Logger, "TLS handshake failed: %v", err)
+		s.closing = true
+		return
+	}
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(s.conn)
+	s.writer = bufio.NewWriter(s.conn)
+	s.tlsActive = true
+	s.username = ""
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// transfer is a data transfer running in the background, so the control
+// connection can still take ABOR and STAT while it runs.
+type transfer struct {
+	// desc is the command being run, e.g. "RETR /a.txt"
+	desc    string
+	started time.Time
+	bytes   atomic.Int64
+
+	ctx   context.Context
+	abort context.CancelFunc
+
+	// done receives the final reply once the transfer has ended
+	done chan string
+}
+
+// startTransfer opens the data connection negotiated in data and runs fn on it
+// in the background. file, if not nil, is closed when the transfer ends.
+// okReply is sent if fn succeeds.
+func startTransfer(data *dataChannel, desc string, okReply string, file io.Closer, fn func(conn io.ReadWriter) error) *transfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &transfer{
+		desc:    desc,
+		started: time.Now(),
+		ctx:     ctx,
+		abort:   cancel,
+		done:    make(chan string, 1),
+	}
+	go t.run(data.take(), okReply, file, fn)
+	return t
+}
+
+// sendData starts a transfer that writes to the client with fn, compressing
+// the data in MODE Z.
+func sendData(data *dataChannel, desc string, okReply string, file io.Closer, fn func(w io.Writer) error) *transfer {
+	compress, level := data.compress, data.compressLevel
+	return startTransfer(data, desc, okReply, file, func(conn io.ReadWriter) error {
+		if !compress {
+			return fn(conn)
+		}
+		zw, err := zlib.NewWriterLevel(conn, level)
+		if err != nil {
+			return err
+		}
+		if err := fn(zw); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// receiveData starts a transfer that reads from the client with fn,
+// decompressing the data in MODE Z.
+func receiveData(data *dataChannel, desc string, okReply string, file io.Closer, fn func(r io.Reader) error) *transfer {
+	compress := data.compress
+	return startTransfer(data, desc, okReply, file, func(conn io.ReadWriter) error {
+		if !compress {
+			return fn(conn)
+		}
+		zr, err := zlib.NewReader(conn)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return fn(zr)
+	})
+}
+
+func (t *transfer) run(data dataChannel, okReply string, file io.Closer, fn func(conn io.ReadWriter) error) {
+	defer t.abort()
+
+	reply := okReply
+	conn, err := data.open(t.ctx)
+	if err == nil {
+		// Aborting closes the connection, which ends any read or write
+		stop := context.AfterFunc(t.ctx, func() { conn.Close() })
+		err = runSafely(data.logger, t.desc, fn, &countingConn{conn, &t.bytes})
+		stop()
+		conn.Close()
+		switch {
+		case errors.Is(err, errTransferPanic):
+			reply = "451 Requested action aborted: local error in processing"
+		case errors.Is(err, errCommitFailed):
+			logf(data.logger, "%s: %v", t.desc, err)
+			reply = "451 Could not save file"
+		case err != nil:
+			reply = "426 Connection closed; transfer aborted"
+		}
+	} else {
+		reply = "425 Can't open data connection"
+	}
+	// A transfer that completed before ABOR still counts
+	if err != nil && t.ctx.Err() != nil {
+		reply = "426 Transfer aborted"
+	}
+
+	// Finish writing before the client hears the transfer is complete
+	if file != nil {
+		file.Close()
+	}
+	t.done <- reply
+}
+
+// errTransferPanic marks a transfer that panicked.
+var errTransferPanic = errors.New("transfer panicked")
+
+// runSafely runs fn, turning a panic into errTransferPanic so that it ends
+// the transfer rather than the server.
+func runSafely(logger *log.Logger, desc string, fn func(conn io.ReadWriter) error, conn io.ReadWriter) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logf(logger, "Panic in %s: %v\n%s", desc, r, debug.Stack())
+			err = errTransferPanic
+		}
+	}()
+	return fn(conn)
+}
+
+// countingConn counts the bytes transferred in either direction.
+type countingConn struct {
+	io.ReadWriter
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// uniqueFact returns the MLST "unique" fact for a file. It is only available
+// on Unix.
+func uniqueFact(info os.FileInfo) string {
+	return ""
+}
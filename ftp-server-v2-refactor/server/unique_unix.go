@@ -0,0 +1,19 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// uniqueFact returns the MLST "unique" fact for a file: its device and inode
+// numbers, which stay the same across renames.
+func uniqueFact(info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%xU%x", uint64(st.Dev), uint64(st.Ino))
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strings"
+)
+
+// tempUploadPrefix starts the names of the hidden files uploads are written to
+// until they are complete. Listings leave them out.
+const tempUploadPrefix = ".ftpupload-"
+
+// errCommitFailed marks an upload that arrived but could not be saved under
+// its final name.
+var errCommitFailed = errors.New("could not save upload")
+
+// upload is where STOR, APPE and STOU write the data they receive.
+type upload interface {
+	io.WriteCloser
+	// commit is called once all data has arrived. Close is called in any
+	// case when the transfer ends.
+	commit() error
+}
+
+// inPlaceUpload writes straight into the destination, as appending and
+// resuming need the data already there.
+type inPlaceUpload struct {
+	File
+}
+
+func (u inPlaceUpload) commit() error {
+	return nil
+}
+
+// tempUpload writes to a hidden temporary file next to the destination and
+// renames it into place on commit, so nobody ever sees a partial file. If the
+// upload is not committed Close deletes the temporary file.
+type tempUpload struct {
+	File
+	fsys FileSystem
+	name string
+	dest string
+	// noReplace makes commit fail rather than replace an existing file
+	noReplace bool
+	committed bool
+}
+
+func createTempUpload(fsys FileSystem, dest string, noReplace bool) (*tempUpload, error) {
+	for i := 0; i < 100; i++ {
+		name := path.Join(path.Dir(dest), fmt.Sprintf("%s%016x", tempUploadPrefix, rand.Uint64()))
+		f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &tempUpload{File: f, fsys: fsys, name: name, dest: dest, noReplace: noReplace}, nil
+	}
+	return nil, fmt.Errorf("no free temporary name next to %s", dest)
+}
+
+func (u *tempUpload) commit() error {
+	if err := u.File.Close(); err != nil {
+		return fmt.Errorf("%w: %v", errCommitFailed, err)
+	}
+	if u.noReplace {
+		// Claim dest first: creating it fails if it exists, where the
+		// rename would replace it
+		f, err := u.fsys.OpenFile(u.dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errCommitFailed, err)
+		}
+		f.Close()
+	}
+	if err := u.fsys.Rename(u.name, u.dest); err != nil {
+		if u.noReplace {
+			u.fsys.Remove(u.dest)
+		}
+		return fmt.Errorf("%w: %v", errCommitFailed, err)
+	}
+	u.committed = true
+	return nil
+}
+
+func (u *tempUpload) Close() error {
+	if u.committed {
+		return nil
+	}
+	u.File.Close()
+	return u.fsys.Remove(u.name)
+}
+
+// isTempUpload reports whether name is an upload in progress.
+func isTempUpload(name string) bool {
+	return strings.HasPrefix(name, tempUploadPrefix)
+}
+
+// uniqueName returns a name for STOU in the virtual directory dir that is not
+// taken yet: base itself, or base with a number appended.
+func uniqueName(fsys FileSystem, dir string, base string) (string, bool) {
+	for i := 0; i < 1000; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", base, i)
+		}
+		if _, err := fsys.Stat(path.Join(dir, name)); os.IsNotExist(err) {
+			return path.Join(dir, name), true
+		}
+	}
+	return "", false
+}
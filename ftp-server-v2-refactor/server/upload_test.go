@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newPassiveChannel returns a data channel listening on a local port.
+func newPassiveChannel(t *testing.T) *dataChannel {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &dataChannel{}
+	data.setPassive(ln)
+	t.Cleanup(data.reset)
+	return data
+}
+
+// sendUpload connects to addr and sends content.
+func sendUpload(t *testing.T, addr, content string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, content)
+	conn.Close()
+}
+
+func TestConcurrentStorWithoutOverwrite(t *testing.T) {
+	fsys := NewMemFileSystem()
+	user := &User{Name: "anonymous", Perms: PermUploadOnly}
+
+	// Both uploads pass the existence check before either has finished
+	var transfers []*transfer
+	var addrs []string
+	for range 2 {
+		var out bytes.Buffer
+		data := newPassiveChannel(t)
+		addrs = append(addrs, data.listener.Addr().String())
+		tr := handleStorCommand(bufio.NewWriter(&out), "drop.txt", user, fsys, "/", data, "I", false, 0)
+		if tr == nil {
+			t.Fatalf("STOR: reply %q", strings.TrimSpace(out.String()))
+		}
+		transfers = append(transfers, tr)
+	}
+
+	sendUpload(t, addrs[0], "first")
+	if reply := <-transfers[0].done; !strings.HasPrefix(reply, "226") {
+		t.Fatalf("first upload: %q", reply)
+	}
+	sendUpload(t, addrs[1], "second")
+	if reply := <-transfers[1].done; !strings.HasPrefix(reply, "451") {
+		t.Errorf("second upload: %q, want 451", reply)
+	}
+
+	f, err := fsys.Open("/drop.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if string(got) != "first" {
+		t.Errorf("drop.txt holds %q, want %q", got, "first")
+	}
+	entries, _ := fsys.ReadDir("/")
+	if len(entries) != 1 {
+		t.Errorf("%d entries left in /, want only drop.txt", len(entries))
+	}
+}